@@ -2,24 +2,51 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/levinalex/go-urlutil"
+	"github.com/levinalex/orthanctool/ratelimit"
 )
 
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
+// HTTPError is returned when Orthanc responds with a non-success status code.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string { return fmt.Sprintf("http error %d", e.StatusCode) }
+
+// defaultTimeout limits the time of a whole request including reading the response.
+const defaultTimeout = 600 * time.Second
+
 type Api struct {
 	BaseURL *url.URL
 	client  *http.Client
 	Logger  Logger
+
+	// username and password are sent with every request if set, instead of credentials in BaseURL
+	username string
+	password string
+
+	// Bandwidth limits the bytes per second of instance downloads and uploads.
+	Bandwidth *ratelimit.Limiter
+	// Requests limits the number of requests per second.
+	Requests *ratelimit.Limiter
+	// ChangeFeed, if set, is used by change watches that have caught up instead of polling themselves.
+	ChangeFeed *ChangeFeed
+	// Metrics, if set, is notified of every request.
+	Metrics Metrics
 }
 
 func (a *Api) url(tpl string, vars map[string]string) string {
@@ -35,20 +62,54 @@ func (a *Api) get(ctx context.Context, pathTpl string, vars map[string]string, r
 	return err
 }
 
+func (a *Api) post(ctx context.Context, pathTpl string, vars map[string]string, body interface{}, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", a.url(pathTpl, vars), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = a.do(ctx, req, result)
+	return err
+}
+
 func (a *Api) do(ctx context.Context, req *http.Request, result interface{}) (*http.Response, error) {
 	if a.Logger != nil {
 		a.Logger.Printf("%s %s\n", req.Method, req.URL)
 	}
+	if err := a.Requests.WaitN(ctx, 1); err != nil {
+		return nil, err
+	}
 	req = req.WithContext(ctx)
+	if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+	if a.Metrics != nil && req.Body != nil {
+		req.Body = countingReadCloser{req.Body, func(n int64) { a.Metrics.Transferred(0, n) }}
+	}
+	started := time.Now()
 	resp, err := a.client.Do(req)
 
+	if a.Metrics != nil {
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body = countingReadCloser{resp.Body, func(n int64) { a.Metrics.Transferred(n, 0) }}
+		}
+		a.Metrics.Request(req.Method, a.endpoint(req.URL), status, time.Since(started))
+	}
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("http error %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode}
 	}
 	if result != nil {
+		defer resp.Body.Close()
 		err = json.NewDecoder(resp.Body).Decode(&result)
 		if err != nil {
 			return nil, fmt.Errorf("json decode error: %s", err.Error())
@@ -58,13 +119,44 @@ func (a *Api) do(ctx context.Context, req *http.Request, result interface{}) (*h
 	return resp, nil
 }
 
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitBandwidth applies the Bandwidth limit to the body of a download.
+func (a *Api) limitBandwidth(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if a.Bandwidth == nil {
+		return body
+	}
+	return limitedReadCloser{a.Bandwidth.Reader(ctx, body), body}
+}
+
 // New returns a new API Client with default settings.
 func New(baseURL string) (*Api, error) {
+	return NewWithOptions(baseURL, Options{})
+}
+
+// Options are settings of an API client that differ from the defaults used by New.
+type Options struct {
+	Username  string
+	Password  string
+	Timeout   time.Duration // 0 for the default of 10 minutes
+	TLSConfig *tls.Config
+}
+
+// NewWithOptions returns a new API Client using the given settings.
+func NewWithOptions(baseURL string, o Options) (*Api, error) {
 	u, err := url.Parse(baseURL)
-	return &Api{BaseURL: u, client: &http.Client{
-		Timeout: 600 * time.Second,
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &Api{BaseURL: u, username: o.Username, password: o.Password, client: &http.Client{
+		Timeout: timeout,
 		Transport: &http.Transport{
 			DisableKeepAlives: true,
+			TLSClientConfig:   o.TLSConfig,
 		},
 	}}, err
 }
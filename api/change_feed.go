@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// feedSize is the number of recent changes a ChangeFeed keeps for watches that are behind.
+const feedSize = 10000
+
+// ChangeFeed shares the polling of changes between several ChangeWatches of the same server.
+// A watch that has caught up asks the feed for new changes. The feed only polls the server if no
+// other watch has done so within the poll interval of the asking watch.
+type ChangeFeed struct {
+	api *Api
+
+	m       sync.Mutex
+	changes []ChangeResult // the known changes after first, up to last
+	first   int
+	last    int
+	polled  time.Time
+	polling chan struct{} // closed when the running poll finishes, nil if none is running
+}
+
+// NewChangeFeed returns a feed polling the changes of a.
+func NewChangeFeed(a *Api) *ChangeFeed {
+	return &ChangeFeed{api: a}
+}
+
+// since returns the changes after since, polling the server if the feed is older than maxAge.
+// ok is false if the feed does not know all changes after since, the watch then fetches them itself.
+func (f *ChangeFeed) since(ctx context.Context, since int, maxAge time.Duration) (result ChangesResult, ok bool, err error) {
+	for {
+		f.m.Lock()
+		if f.polled.IsZero() && f.polling == nil {
+			f.first, f.last = since, since
+		}
+		if since < f.first {
+			f.m.Unlock()
+			return result, false, nil
+		}
+		if polling := f.polling; polling != nil {
+			f.m.Unlock()
+			select {
+			case <-polling:
+				continue
+			case <-ctx.Done():
+				return result, false, ctx.Err()
+			}
+		}
+		if time.Since(f.polled) < maxAge {
+			result = f.after(since)
+			f.m.Unlock()
+			return result, true, nil
+		}
+
+		f.polling = make(chan struct{})
+		from := f.last
+		f.m.Unlock()
+
+		changes, last, err := f.poll(ctx, from)
+
+		f.m.Lock()
+		if err == nil {
+			f.add(changes, last)
+		}
+		close(f.polling)
+		f.polling = nil
+		f.m.Unlock()
+		if err != nil {
+			return result, false, err
+		}
+	}
+}
+
+// poll fetches all changes after since.
+func (f *ChangeFeed) poll(ctx context.Context, since int) ([]ChangeResult, int, error) {
+	changes := []ChangeResult{}
+	for {
+		result, err := f.api.Changes(ctx, since, 0)
+		if err != nil {
+			return nil, since, err
+		}
+		changes = append(changes, result.Changes...)
+		since = result.Last
+		if result.Done {
+			return changes, since, nil
+		}
+	}
+}
+
+// add appends polled changes and drops the oldest ones beyond feedSize. f.m must be held.
+func (f *ChangeFeed) add(changes []ChangeResult, last int) {
+	f.changes = append(f.changes, changes...)
+	if drop := len(f.changes) - feedSize; drop > 0 {
+		f.first = f.changes[drop-1].Seq
+		f.changes = append([]ChangeResult(nil), f.changes[drop:]...)
+	}
+	f.last = last
+	f.polled = time.Now()
+}
+
+// after returns the known changes after since. f.m must be held.
+func (f *ChangeFeed) after(since int) ChangesResult {
+	i := sort.Search(len(f.changes), func(i int) bool { return f.changes[i].Seq > since })
+	result := ChangesResult{
+		Changes: append([]ChangeResult(nil), f.changes[i:]...),
+		Done:    true,
+		Last:    f.last,
+	}
+	if since > f.last {
+		result.Last = since
+	}
+	return result
+}
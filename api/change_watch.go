@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -10,6 +12,10 @@ type ChangeWatch struct {
 	StopIndex    int
 	StopAtEnd    bool
 	PollInterval time.Duration
+	// OnPoll is called whenever the watch has caught up with the changes of the server, if it is set.
+	// Unless StopAtEnd is set, it is also called with the error of a poll that got no response from the
+	// server, the watch then polls again after PollInterval instead of returning the error.
+	OnPoll func(err error)
 }
 
 var DefaultPollInterval = 60 * time.Second
@@ -26,13 +32,26 @@ func (cw ChangeWatch) Run(ctx context.Context, api *Api, f func(ChangeResult)) e
 	}
 
 	since := cw.StartIndex
+	caughtUp := false
 	for {
 		if ctx.Err() != nil {
 			break
 		}
-		changes, err := api.Changes(ctx, since, 0)
+		changes, err := cw.changes(ctx, api, since, caughtUp, sleepTime)
 		if err != nil {
-			return err
+			if cw.OnPoll == nil || cw.StopAtEnd || ctx.Err() != nil || !unavailable(err) {
+				return err
+			}
+			if api.Logger != nil {
+				api.Logger.Printf("polling changes failed: %s, trying again in %s\n", err, sleepTime)
+			}
+			cw.OnPoll(err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(sleepTime):
+				continue
+			}
 		}
 		for _, cng := range changes.Changes {
 			if ctx.Err() != nil {
@@ -47,6 +66,10 @@ func (cw ChangeWatch) Run(ctx context.Context, api *Api, f func(ChangeResult)) e
 		since = changes.Last
 
 		if changes.Done {
+			caughtUp = true
+			if cw.OnPoll != nil {
+				cw.OnPoll(nil)
+			}
 			if cw.StopAtEnd {
 				return nil
 			}
@@ -60,3 +83,28 @@ func (cw ChangeWatch) Run(ctx context.Context, api *Api, f func(ChangeResult)) e
 	}
 	return nil
 }
+
+// changes returns the changes after since, from the change feed of api if the watch has caught up.
+func (cw ChangeWatch) changes(ctx context.Context, api *Api, since int, caughtUp bool, pollInterval time.Duration) (ChangesResult, error) {
+	if caughtUp && api.ChangeFeed != nil {
+		result, ok, err := api.ChangeFeed.since(ctx, since, pollInterval)
+		if ok || err != nil {
+			return result, err
+		}
+	}
+	return api.Changes(ctx, since, 0)
+}
+
+// unavailable reports whether err means that the server did not respond, or a proxy in front of it could not
+// reach it.
+func unavailable(err error) bool {
+	if e, ok := err.(*HTTPError); ok {
+		switch e.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	_, ok := err.(*url.Error)
+	return ok
+}
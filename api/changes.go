@@ -30,12 +30,18 @@ func (a *Api) Changes(ctx context.Context, since, limit int) (result ChangesResu
 	}
 
 	err = a.get(ctx, "changes{?last,since,limit}", vars, &result)
+	if err == nil && result.Done && a.Metrics != nil {
+		a.Metrics.LastChange(result.Last)
+	}
 	return result, err
 }
 
 func (a *Api) LastChange(ctx context.Context) (result ChangeResult, last int, err error) {
 	var changes ChangesResult
 	err = a.get(ctx, "changes?last", nil, &changes)
+	if err == nil && a.Metrics != nil {
+		a.Metrics.LastChange(changes.Last)
+	}
 	if idx := len(changes.Changes); idx > 0 {
 		result = changes.Changes[idx-1]
 	}
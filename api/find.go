@@ -0,0 +1,15 @@
+package api
+
+import "context"
+
+type findRequest struct {
+	Level string            `json:"Level"`
+	Query map[string]string `json:"Query"`
+}
+
+// Find returns the IDs of all resources of the given level ("Patient", "Study", "Series" or "Instance")
+// whose main DICOM tags match query. Values may contain wildcards, dates may be ranges like "20200101-20201231".
+func (a *Api) Find(ctx context.Context, level string, query map[string]string) (result []string, err error) {
+	err = a.post(ctx, "tools/find", nil, findRequest{Level: level, Query: query}, &result)
+	return result, err
+}
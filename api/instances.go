@@ -23,6 +23,7 @@ type GetInstanceResponse struct {
 	Type          string            `json:"Type"`
 	FileSize      int               `json:"FileSize"`
 	MainDicomTags map[string]string `json:"MainDicomTags"`
+	ParentSeries  string            `json:"ParentSeries"`
 }
 
 func (a *Api) GetInstance(ctx context.Context, id string) (result GetInstanceResponse, err error) {
@@ -44,6 +45,7 @@ func (a *Api) GetInstanceTags(ctx context.Context, id string) (result GetInstanc
 	return result, err
 }
 
+// InstanceFile downloads the DICOM file of an instance. The download is subject to the Bandwidth limit.
 func (a *Api) InstanceFile(ctx context.Context, id string) (r io.ReadCloser, len int64, err error) {
 	req, err := http.NewRequest("GET", a.url("instances/{id}/file", map[string]string{"id": id}), nil)
 	if err != nil {
@@ -53,7 +55,7 @@ func (a *Api) InstanceFile(ctx context.Context, id string) (r io.ReadCloser, len
 	if err != nil {
 		return nil, 0, err
 	}
-	return resp.Body, resp.ContentLength, nil
+	return a.limitBandwidth(ctx, resp.Body), resp.ContentLength, nil
 }
 
 func (a *Api) GetInstancePreview(ctx context.Context, id string) (r io.ReadCloser, len int64, err error) {
@@ -74,9 +76,15 @@ type PostInstanceResponse struct {
 	Status string `json:"Status"`
 }
 
+// PostInstance uploads a DICOM file. The upload is subject to the Bandwidth limit.
 func (a *Api) PostInstance(ctx context.Context, data io.Reader, len int64) (result PostInstanceResponse, err error) {
 	url := a.url("instances", nil)
 
+	if rc, ok := data.(io.ReadCloser); ok {
+		data = a.limitBandwidth(ctx, rc) // keep the Closer so the request closes it
+	} else if a.Bandwidth != nil {
+		data = a.Bandwidth.Reader(ctx, data)
+	}
 	req, err := http.NewRequest("POST", url, data)
 	if err != nil {
 		return result, err
@@ -86,3 +94,20 @@ func (a *Api) PostInstance(ctx context.Context, data io.Reader, len int64) (resu
 	_, err = a.do(ctx, req, &result)
 	return result, err
 }
+
+// PostArchive uploads a ZIP file of DICOM instances (supported since Orthanc 1.8.2).
+// The upload is subject to the Bandwidth limit.
+func (a *Api) PostArchive(ctx context.Context, data io.Reader, len int64) (result []PostInstanceResponse, err error) {
+	if a.Bandwidth != nil {
+		data = a.Bandwidth.Reader(ctx, data)
+	}
+	req, err := http.NewRequest("POST", a.url("instances", nil), data)
+	if err != nil {
+		return result, err
+	}
+	req.ContentLength = len
+	req.Header.Set("Content-Type", "application/zip")
+
+	_, err = a.do(ctx, req, &result)
+	return result, err
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+)
+
+// JobCreatedResponse is returned when Orthanc starts an asynchronous job.
+type JobCreatedResponse struct {
+	ID   string
+	Path string
+}
+
+type GetJobResponse struct {
+	ID               string
+	Type             string
+	State            string // Pending, Running, Success, Failure, Paused or Retry
+	Progress         int    // percent
+	ErrorCode        int
+	ErrorDescription string
+}
+
+func (a *Api) GetJob(ctx context.Context, id string) (result GetJobResponse, err error) {
+	err = a.get(ctx, "jobs/{id}", map[string]string{"id": id}, &result)
+	return result, err
+}
+
+// CancelJob cancels a pending, running or paused job.
+func (a *Api) CancelJob(ctx context.Context, id string) error {
+	var result struct{}
+	return a.post(ctx, "jobs/{id}/cancel", map[string]string{"id": id}, struct{}{}, &result)
+}
+
+func (a *Api) Plugins(ctx context.Context) (result []string, err error) {
+	err = a.get(ctx, "plugins", nil, &result)
+	return result, err
+}
+
+func (a *Api) Peers(ctx context.Context) (result []string, err error) {
+	err = a.get(ctx, "peers", nil, &result)
+	return result, err
+}
+
+// StoreToPeer starts a job that sends resources to an Orthanc peer.
+func (a *Api) StoreToPeer(ctx context.Context, peer string, resources []string) (result JobCreatedResponse, err error) {
+	body := map[string]interface{}{
+		"Resources":    resources,
+		"Asynchronous": true,
+	}
+	err = a.post(ctx, "peers/{peer}/store", map[string]string{"peer": peer}, body, &result)
+	return result, err
+}
+
+type TransferResource struct {
+	Level string
+	ID    string
+}
+
+// TransferToPeer starts a job that sends resources to an Orthanc peer using the transfers accelerator plugin.
+func (a *Api) TransferToPeer(ctx context.Context, peer string, resources []TransferResource) (result JobCreatedResponse, err error) {
+	body := map[string]interface{}{
+		"Resources":   resources,
+		"Compression": "gzip",
+		"Peer":        peer,
+	}
+	err = a.post(ctx, "transfers/send", nil, body, &result)
+	return result, err
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Metrics receives measurements of the requests made by an Api, e.g. to export them to Prometheus.
+type Metrics interface {
+	// Request is called once the response headers of a request arrived. status is 0 if the request
+	// failed without a response. endpoint is the path with IDs replaced by {id}, like instances/{id}/file.
+	Request(method, endpoint string, status int, duration time.Duration)
+	// Transferred is called with the number of bytes read from response bodies and written with request bodies.
+	Transferred(downloaded, uploaded int64)
+	// LastChange is called with the sequence number of the newest change of the server.
+	LastChange(seq int)
+}
+
+// resourceID matches Orthanc resource IDs, job UUIDs and sequence numbers, which must not become part
+// of endpoint names.
+var resourceID = regexp.MustCompile(`^([0-9a-f]{8}(-[0-9a-f]{4,12})+|[0-9]+)$`)
+
+// endpoint returns the path of u below the BaseURL with resource IDs replaced by {id}.
+func (a *Api) endpoint(u *url.URL) string {
+	path := strings.TrimPrefix(u.Path, a.BaseURL.Path)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, p := range parts {
+		if resourceID.MatchString(p) {
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// countingReadCloser reports the bytes read through it.
+type countingReadCloser struct {
+	io.ReadCloser
+	count func(n int64)
+}
+
+func (c countingReadCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if n > 0 {
+		c.count(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestEndpoint(t *testing.T) {
+	a, err := New("http://orthanc.example/orthanc/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path     string
+		endpoint string
+	}{
+		{"/orthanc/instances/b9c08539-26f93bde-c81ab0d7-bffaf2cb-a4d0bdd0/file", "instances/{id}/file"},
+		{"/orthanc/studies/b9c08539-26f93bde-c81ab0d7-bffaf2cb-a4d0bdd0", "studies/{id}"},
+		{"/orthanc/jobs/8c8e4c0c-1f0e-4a4b-9e1b-3f6a0f8c2e7d", "jobs/{id}"},
+		{"/orthanc/jobs/8c8e4c0c-1f0e-4a4b-9e1b-3f6a0f8c2e7d/archive", "jobs/{id}/archive"},
+		{"/orthanc/changes/2071", "changes/{id}"},
+		{"/orthanc/changes", "changes"},
+		{"/orthanc/tools/find", "tools/find"},
+		{"/orthanc/peers/orthanc-b/store", "peers/orthanc-b/store"},
+		{"/orthanc/modalities/deadbeef", "modalities/deadbeef"},
+		{"/orthanc/statistics", "statistics"},
+	}
+	for _, test := range tests {
+		if got := a.endpoint(&url.URL{Path: test.path}); got != test.endpoint {
+			t.Errorf("endpoint(%s) = %s, expected %s", test.path, got, test.endpoint)
+		}
+	}
+}
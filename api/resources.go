@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// resourceCollection maps an Orthanc resource type (as used in ChangeResult.ResourceType)
+// to the name of its REST collection.
+func resourceCollection(resourceType string) (string, error) {
+	switch resourceType {
+	case "Patient":
+		return "patients", nil
+	case "Study":
+		return "studies", nil
+	case "Series":
+		return "series", nil
+	case "Instance":
+		return "instances", nil
+	}
+	return "", fmt.Errorf("unknown resource type %q", resourceType)
+}
+
+// DeleteResource deletes a patient, study, series or instance.
+func (a *Api) DeleteResource(ctx context.Context, resourceType, id string) error {
+	collection, err := resourceCollection(resourceType)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", a.url("{collection}/{id}", map[string]string{"collection": collection, "id": id}), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(ctx, req, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Labels returns the labels attached to a resource. Labels require Orthanc 1.12 or later.
+func (a *Api) Labels(ctx context.Context, resourceType, id string) (result []string, err error) {
+	collection, err := resourceCollection(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	err = a.get(ctx, "{collection}/{id}/labels", map[string]string{"collection": collection, "id": id}, &result)
+	return result, err
+}
+
+// ResourceInstances returns the IDs of all instances below a resource.
+func (a *Api) ResourceInstances(ctx context.Context, resourceType, id string) (result []string, err error) {
+	if resourceType == "Instance" {
+		_, err = a.GetInstance(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return []string{id}, nil
+	}
+
+	collection, err := resourceCollection(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	var instances []GetInstanceResponse
+	err = a.get(ctx, "{collection}/{id}/instances", map[string]string{"collection": collection, "id": id}, &instances)
+	for _, i := range instances {
+		result = append(result, i.ID)
+	}
+	return result, err
+}
@@ -19,3 +19,9 @@ func (a *Api) GetSeries(ctx context.Context, id string) (result GetSeriesRespons
 	err = a.get(ctx, "series/{id}", map[string]string{"id": id}, &result)
 	return result, err
 }
+
+// SeriesInstances returns the details of all instances of a series.
+func (a *Api) SeriesInstances(ctx context.Context, id string) (result []GetInstanceResponse, err error) {
+	err = a.get(ctx, "series/{id}/instances", map[string]string{"id": id}, &result)
+	return result, err
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"context"
+)
+
+type StatisticsResponse struct {
+	CountInstances          int
+	CountPatients           int
+	CountSeries             int
+	CountStudies            int
+	TotalDiskSizeMB         int
+	TotalUncompressedSizeMB int
+}
+
+func (a *Api) Statistics(ctx context.Context) (result StatisticsResponse, err error) {
+	err = a.get(ctx, "statistics", nil, &result)
+	return result, err
+}
@@ -2,6 +2,9 @@ package api
 
 import (
 	"context"
+	"io"
+	"net/http"
+	"strconv"
 )
 
 type GetStudyResponse struct {
@@ -19,3 +22,31 @@ func (a *Api) GetStudy(ctx context.Context, id string) (result GetStudyResponse,
 	err = a.get(ctx, "studies/{id}", map[string]string{"id": id}, &result)
 	return result, err
 }
+
+// StudySeries returns the details of all series of a study.
+func (a *Api) StudySeries(ctx context.Context, id string) (result []GetSeriesResponse, err error) {
+	err = a.get(ctx, "studies/{id}/series", map[string]string{"id": id}, &result)
+	return result, err
+}
+
+func (a *Api) StudyDetailsSince(ctx context.Context, since, limit int) (result []GetStudyResponse, err error) {
+	err = a.get(ctx, "studies{?since,limit,expand}", map[string]string{
+		"since":  strconv.Itoa(since),
+		"limit":  strconv.Itoa(limit),
+		"expand": "1",
+	}, &result)
+	return result, err
+}
+
+// StudyArchive downloads all instances of a study as a ZIP file. The download is subject to the Bandwidth limit.
+func (a *Api) StudyArchive(ctx context.Context, id string) (r io.ReadCloser, len int64, err error) {
+	req, err := http.NewRequest("GET", a.url("studies/{id}/archive", map[string]string{"id": id}), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := a.do(ctx, req, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return a.limitBandwidth(ctx, resp.Body), resp.ContentLength, nil
+}
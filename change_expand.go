@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+// maxCachedResources limits the number of series and studies whose tags are remembered for -expand.
+const maxCachedResources = 10000
+
+// resourceTags identifies a parent resource of a change.
+type resourceTags struct {
+	ID            string
+	MainDicomTags map[string]string
+}
+
+// expandedChange is a change together with the tags of the changed resource and its parents.
+type expandedChange struct {
+	api.ChangeResult
+	MainDicomTags map[string]string           `json:",omitempty"`
+	Series        *resourceTags               `json:",omitempty"`
+	Study         *resourceTags               `json:",omitempty"`
+	Patient       *resourceTags               `json:",omitempty"`
+	Tags          api.GetInstanceTagsResponse `json:",omitempty"` // all tags of an instance, with -expand-tags
+}
+
+// cacheEntry is a cached lookup. done is closed once value and err are set.
+type cacheEntry struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// resourceCache remembers lookups. Concurrent lookups of the same key wait for the first one
+// instead of sending the same request again. Failed lookups are not remembered.
+type resourceCache struct {
+	m       sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func (c *resourceCache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.m.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.m.Unlock()
+		<-e.done
+		return e.value, e.err
+	}
+	if c.entries == nil || len(c.entries) >= maxCachedResources {
+		c.entries = map[string]*cacheEntry{}
+	}
+	e := &cacheEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.m.Unlock()
+
+	e.value, e.err = fetch()
+	if e.err != nil {
+		c.m.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.m.Unlock()
+	}
+	close(e.done)
+	return e.value, e.err
+}
+
+// changeExpander looks up the tags of changed resources and their parents.
+type changeExpander struct {
+	orthanc *api.Api
+	tags    bool // also fetch all tags of instances
+	cache   resourceCache
+}
+
+func (e *changeExpander) series(ctx context.Context, id string) (api.GetSeriesResponse, error) {
+	v, err := e.cache.get("series/"+id, func() (interface{}, error) {
+		return e.orthanc.GetSeries(ctx, id)
+	})
+	series, _ := v.(api.GetSeriesResponse)
+	return series, err
+}
+
+func (e *changeExpander) study(ctx context.Context, id string) (api.GetStudyResponse, error) {
+	v, err := e.cache.get("studies/"+id, func() (interface{}, error) {
+		return e.orthanc.GetStudy(ctx, id)
+	})
+	study, _ := v.(api.GetStudyResponse)
+	return study, err
+}
+
+// expand returns the change with the tags of its resource and parents. On errors, the tags that
+// could be looked up are returned along with the error.
+func (e *changeExpander) expand(ctx context.Context, cng api.ChangeResult) (expandedChange, error) {
+	x := expandedChange{ChangeResult: cng}
+
+	var seriesID, studyID string
+	switch cng.ResourceType {
+	case "Patient":
+		patient, err := e.orthanc.GetPatient(ctx, cng.ID)
+		x.MainDicomTags = patient.MainDicomTags
+		return x, err
+	case "Study":
+		studyID = cng.ID
+	case "Series":
+		seriesID = cng.ID
+	case "Instance":
+		instance, err := e.orthanc.GetInstance(ctx, cng.ID)
+		if err != nil {
+			return x, err
+		}
+		x.MainDicomTags = instance.MainDicomTags
+		if e.tags {
+			if x.Tags, err = e.orthanc.GetInstanceTags(ctx, cng.ID); err != nil {
+				return x, err
+			}
+		}
+		seriesID = instance.ParentSeries
+	default:
+		return x, nil
+	}
+
+	if seriesID != "" {
+		series, err := e.series(ctx, seriesID)
+		if err != nil {
+			return x, err
+		}
+		if cng.ResourceType == "Series" {
+			x.MainDicomTags = series.MainDicomTags
+		} else {
+			x.Series = &resourceTags{ID: seriesID, MainDicomTags: series.MainDicomTags}
+		}
+		studyID = series.ParentStudy
+	}
+
+	study, err := e.study(ctx, studyID)
+	if err != nil {
+		return x, err
+	}
+	if cng.ResourceType == "Study" {
+		x.MainDicomTags = study.MainDicomTags
+	} else {
+		x.Study = &resourceTags{ID: studyID, MainDicomTags: study.MainDicomTags}
+	}
+	x.Patient = &resourceTags{ID: study.ParentPatient, MainDicomTags: study.PatientMainDicomTags}
+	return x, nil
+}
+
+// expandSink passes changes to the next sink after expanding them. A change whose resource could
+// not be looked up (it may have been deleted already) is passed on with the tags that were found.
+type expandSink struct {
+	EventSink
+	expander *changeExpander
+}
+
+func (s expandSink) Send(ctx context.Context, event interface{}) error {
+	cng, ok := event.(api.ChangeResult)
+	if !ok {
+		return s.EventSink.Send(ctx, event)
+	}
+	x, err := s.expander.expand(ctx, cng)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Fprintf(os.Stderr, "expand change %d (%s %s): %s\n", cng.Seq, cng.ChangeType, cng.ID, err.Error())
+	}
+	return s.EventSink.Send(ctx, x)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const checkpointSaveInterval = time.Second
+
+// maxCheckpointFailures is the number of writes in a row that may fail before the checkpoint is given up.
+// A failed write is retried after checkpointSaveInterval.
+const maxCheckpointFailures = 10
+
+// checkpointState is the content of a checkpoint file.
+type checkpointState struct {
+	Seq  int
+	Time string
+}
+
+// checkpoint remembers the highest change sequence number up to which all changes have been handled.
+// Changes may finish out of order, the checkpoint only advances past a change once every earlier
+// change is done as well. A nil checkpoint does nothing.
+type checkpoint struct {
+	path string
+
+	m        sync.Mutex
+	inFlight map[int]bool
+	last     int // highest Seq started
+	saved    int
+	lastSave time.Time
+	failures int // writes that failed in a row
+}
+
+// readCheckpoint returns the checkpoint stored at path and whether it exists.
+func readCheckpoint(path string) (*checkpoint, bool, error) {
+	c := &checkpoint{path: path, inFlight: map[int]bool{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var state checkpointState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, false, err
+	}
+	c.last, c.saved = state.Seq, state.Seq
+	return c, true, nil
+}
+
+// seq returns the sequence number up to which all changes are done.
+func (c *checkpoint) seq() int {
+	safe := c.last
+	for seq := range c.inFlight {
+		if seq-1 < safe {
+			safe = seq - 1
+		}
+	}
+	return safe
+}
+
+func (c *checkpoint) start(seq int) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.inFlight[seq] = true
+	if seq > c.last {
+		c.last = seq
+	}
+}
+
+func (c *checkpoint) done(seq int) error {
+	if c == nil {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.inFlight, seq)
+	if time.Since(c.lastSave) < checkpointSaveInterval {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// failing reports whether the last maxCheckpointFailures writes failed.
+func (c *checkpoint) failing() bool {
+	if c == nil {
+		return false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.failures >= maxCheckpointFailures
+}
+
+// save writes the checkpoint, it is called when the command exits.
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.saveLocked()
+}
+
+func (c *checkpoint) saveLocked() error {
+	seq := c.seq()
+	if seq == c.saved {
+		return nil
+	}
+	if err := c.write(seq); err != nil {
+		c.failures++
+		c.lastSave = time.Now()
+		return fmt.Errorf("checkpoint %s: %s", c.path, err.Error())
+	}
+	c.saved, c.lastSave, c.failures = seq, time.Now(), 0
+	return nil
+}
+
+// write stores seq in the checkpoint file.
+func (c *checkpoint) write(seq int) error {
+	b, err := json.Marshal(checkpointState{Seq: seq, Time: time.Now().Format(time.RFC3339)})
+	if err != nil {
+		return err
+	}
+
+	// write a new file and rename it, so the checkpoint is never left half written
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".checkpoint-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
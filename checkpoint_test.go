@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointSeq(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, exists, err := readCheckpoint(filepath.Join(dir, "checkpoint"))
+	if err != nil || exists {
+		t.Fatal(exists, err)
+	}
+
+	for seq := 1; seq <= 6; seq++ {
+		c.start(seq)
+	}
+	// completions arrive out of order, the checkpoint only passes a change once all earlier ones are done
+	steps := []struct {
+		done int
+		seq  int
+	}{
+		{3, 0},
+		{1, 1},
+		{6, 1},
+		{2, 3},
+		{5, 3},
+		{4, 6},
+	}
+	for _, step := range steps {
+		c.done(step.done)
+		if got := c.seq(); got != step.seq {
+			t.Errorf("after change %d is done: seq %d, expected %d", step.done, got, step.seq)
+		}
+	}
+
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	c, exists, err = readCheckpoint(filepath.Join(dir, "checkpoint"))
+	if err != nil || !exists || c.saved != 6 {
+		t.Errorf("read back checkpoint at %d (exists %v, %v), expected 6", c.saved, exists, err)
+	}
+
+	// a resumed checkpoint starts from the saved change
+	c.start(7)
+	c.start(8)
+	c.done(8)
+	if got := c.seq(); got != 6 {
+		t.Errorf("seq %d with change 7 in flight, expected 6", got)
+	}
+}
+
+func TestCheckpointFailing(t *testing.T) {
+	c := &checkpoint{path: filepath.Join("/nonexistent", "checkpoint"), inFlight: map[int]bool{}}
+	for i := 1; i <= maxCheckpointFailures; i++ {
+		c.start(i)
+		c.done(i)
+		if err := c.save(); err == nil {
+			t.Fatal("expected an error writing to a missing directory")
+		}
+	}
+	if !c.failing() {
+		t.Errorf("checkpoint not failing after %d failed writes", maxCheckpointFailures)
+	}
+}
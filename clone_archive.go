@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	transferInstance = "instance"
+	transferArchive  = "archive"
+)
+
+// studyArchive is a study whose missing instances are transferred as a ZIP archive.
+type studyArchive struct {
+	studyID string
+	items   []cloneItem // the missing instances
+}
+
+// copyStudyArchive transfers a study archive and copies the instances that are still missing
+// afterwards one by one.
+func copyStudyArchive(ctx context.Context, source *api.Api, dests []*cloneDest, a *studyArchive, retries int, progress *cloneProgress) error {
+	for _, item := range transferStudyArchive(ctx, source, dests, a.studyID, a.items, progress) {
+		err := copyToDestinations(ctx, source, dests, item, retries, progress)
+		progress.done()
+		if err != nil {
+			return err
+		}
+		if err := activeDestinations(dests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferStudyArchive downloads a study as a single ZIP archive and uploads it to every destination
+// that misses some of its instances. A single destination receives the archive while it is downloaded,
+// for several it is spooled first. It returns the instances that are still missing afterwards, which
+// have to be copied one by one.
+func transferStudyArchive(ctx context.Context, source *api.Api, dests []*cloneDest, studyID string, items []cloneItem, progress *cloneProgress) []cloneItem {
+	targets := []*cloneDest{}
+	seen := map[*cloneDest]bool{}
+	for _, item := range items {
+		for _, d := range item.dests {
+			if !seen[d] && !d.isDetached() {
+				seen[d] = true
+				targets = append(targets, d)
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return items
+	}
+
+	r, size, err := source.StudyArchive(ctx, studyID)
+	if err != nil {
+		fmt.Fprintf(cloneLog, "archive %s failed, copying instances: %s\n", studyID, err.Error())
+		return items
+	}
+	r = progress.reader(r)
+	if len(targets) == 1 {
+		targets[0].sendArchive(ctx, studyID, r, size)
+		r.Close()
+	} else {
+		archive, err := spool(r, size)
+		r.Close()
+		if err != nil {
+			fmt.Fprintf(cloneLog, "archive %s failed, copying instances: %s\n", studyID, err.Error())
+			return items
+		}
+		defer archive.Close()
+
+		for _, d := range targets {
+			d.sendArchive(ctx, studyID, archive.reader(), archive.size)
+		}
+	}
+
+	remaining, _, err := missingStudyInstances(ctx, source, dests, studyID)
+	if err != nil {
+		fmt.Fprintf(cloneLog, "archive %s: %s, copying instances\n", studyID, err.Error())
+		return items
+	}
+	if len(remaining) > 0 {
+		fmt.Fprintf(cloneLog, "archive %s: %d instances still missing, copying them one by one\n", studyID, len(remaining))
+	}
+	progress.doneN(len(items) - len(remaining))
+	return remaining
+}
+
+// sendArchive uploads a study archive of size bytes, or -1 if unknown, and records the stored instances.
+// Instances that did not make it are copied one by one afterwards.
+func (d *cloneDest) sendArchive(ctx context.Context, studyID string, r io.Reader, size int64) {
+	results, err := d.PostArchive(ctx, r, size)
+	if err != nil {
+		fmt.Fprintf(cloneLog, "archive %s%s failed: %s\n", studyID, d.label, err.Error())
+		return
+	}
+	d.finishArchive(studyID, results)
+}
+
+// finishArchive records the instances stored from a study archive.
+func (d *cloneDest) finishArchive(studyID string, results []api.PostInstanceResponse) {
+	stored := []string{}
+	copied, alreadyStored := 0, 0
+	for _, res := range results {
+		switch res.Status {
+		case "Success":
+			copied++
+		case "AlreadyStored":
+			alreadyStored++
+		default:
+			continue
+		}
+		stored = append(stored, res.ID)
+	}
+	if d.remember {
+		d.existing.Add(stored)
+	}
+	fmt.Fprintf(cloneLog, "archive %s%s %d copied, %d already stored\n", studyID, d.label, copied, alreadyStored)
+	instancesCopied.add(float64(copied), d.name(), "Success")
+	instancesCopied.add(float64(alreadyStored), d.name(), "AlreadyStored")
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.copied += copied
+	d.alreadyStored += alreadyStored
+}
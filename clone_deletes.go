@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/levinalex/orthanctool/api"
+	"github.com/levinalex/orthanctool/stringset"
+)
+
+const (
+	deleteDeleted     = "deleted"
+	deleteDryRun      = "dry-run"
+	deleteMissing     = "missing"
+	deleteProtected   = "protected"
+	deleteRateLimited = "rate-limited"
+	deletePending     = "pending"
+	deleteFailed      = "failed"
+)
+
+// deleteTarget is a resource that is deleted at the destination.
+type deleteTarget struct {
+	ResourceType string
+	ID           string
+}
+
+// deletion is a single entry in the delete log.
+type deletion struct {
+	Destination  string
+	ResourceType string
+	ID           string
+	Action       string
+	Label        string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	Time         string
+}
+
+// deleteMirror removes resources from the destination after they have been deleted at the source.
+// Orthanc reports a Deleted change for every instance, series and study removed together with their
+// parent, so the mirror deletes the highest resource that is gone at the source instead, which takes
+// a single slot of the hourly limit. The changes of the other resources then find them missing.
+type deleteMirror struct {
+	source     *api.Api
+	dest       *api.Api
+	existing   *stringset.Set
+	dryRun     bool
+	maxPerHour int
+	protected  []string
+	log        io.Writer
+
+	m      sync.Mutex
+	recent []time.Time
+
+	// serializes mirror and retryPending, so queued deletions are done once and in order
+	serial  sync.Mutex
+	pending []deleteTarget // refused by the hourly limit, oldest first
+}
+
+// allow reports whether another deletion fits into the hourly limit and records it if it does.
+func (d *deleteMirror) allow(now time.Time) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	cutoff := now.Add(-time.Hour)
+	for len(d.recent) > 0 && d.recent[0].Before(cutoff) {
+		d.recent = d.recent[1:]
+	}
+	if d.maxPerHour >= 0 && len(d.recent) >= d.maxPerHour {
+		return false
+	}
+	d.recent = append(d.recent, now)
+	return true
+}
+
+// nextAllowed returns when the hourly limit allows the next deletion.
+func (d *deleteMirror) nextAllowed(now time.Time) time.Time {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	cutoff := now.Add(-time.Hour)
+	recent := d.recent
+	for len(recent) > 0 && recent[0].Before(cutoff) {
+		recent = recent[1:]
+	}
+	if d.maxPerHour < 0 || len(recent) < d.maxPerHour {
+		return now
+	}
+	return recent[len(recent)-d.maxPerHour].Add(time.Hour)
+}
+
+// protectedBy returns the first protected label found on the resource, one of its parents
+// or (for patients) one of its studies.
+func (d *deleteMirror) protectedBy(ctx context.Context, resourceType, id string) (string, error) {
+	if len(d.protected) == 0 {
+		return "", nil
+	}
+
+	type resource struct{ resourceType, id string }
+	resources := []resource{{resourceType, id}}
+
+	switch resourceType {
+	case "Instance":
+		instance, err := d.dest.GetInstance(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		resourceType, id = "Series", instance.ParentSeries
+		resources = append(resources, resource{resourceType, id})
+		fallthrough
+	case "Series":
+		series, err := d.dest.GetSeries(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		resourceType, id = "Study", series.ParentStudy
+		resources = append(resources, resource{resourceType, id})
+		fallthrough
+	case "Study":
+		study, err := d.dest.GetStudy(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		resources = append(resources, resource{"Patient", study.ParentPatient})
+	case "Patient":
+		patient, err := d.dest.GetPatient(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		for _, study := range patient.Studies {
+			resources = append(resources, resource{"Study", study})
+		}
+	}
+
+	for _, r := range resources {
+		labels, err := d.dest.Labels(ctx, r.resourceType, r.id)
+		if err != nil {
+			return "", err
+		}
+		for _, label := range labels {
+			for _, p := range d.protected {
+				if label == p {
+					return label, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// mirror deletes the resource of cng at the destination. Deletions refused by the hourly limit are
+// queued and done in order by later calls and by retryPending once the limit allows.
+func (d *deleteMirror) mirror(ctx context.Context, cng api.ChangeResult) {
+	d.serial.Lock()
+	defer d.serial.Unlock()
+
+	d.retry(ctx)
+	t, err := d.target(ctx, cng.ResourceType, cng.ID)
+	if notFound(err) {
+		d.write(deletion{ResourceType: cng.ResourceType, ID: cng.ID, Action: deleteMissing})
+		return
+	}
+	if err != nil {
+		d.write(deletion{ResourceType: cng.ResourceType, ID: cng.ID, Action: deleteFailed, Error: err.Error()})
+		return
+	}
+	for _, p := range d.pending {
+		if p == t {
+			return // queued for another change already
+		}
+	}
+	if len(d.pending) > 0 {
+		d.pending = append(d.pending, t)
+		d.write(deletion{ResourceType: t.ResourceType, ID: t.ID, Action: deleteRateLimited})
+		return
+	}
+	if d.apply(ctx, t) == deleteRateLimited {
+		d.pending = append(d.pending, t)
+	}
+}
+
+// target returns the resource to delete for a resource deleted at the source: the resource itself,
+// or its highest parent at the destination that is gone at the source as well.
+func (d *deleteMirror) target(ctx context.Context, resourceType, id string) (deleteTarget, error) {
+	t := deleteTarget{ResourceType: resourceType, ID: id}
+	for {
+		parentType, parentID, err := parentOf(ctx, d.dest, t.ResourceType, t.ID)
+		if err != nil || parentType == "" {
+			return t, err
+		}
+		_, _, err = parentOf(ctx, d.source, parentType, parentID)
+		if !notFound(err) {
+			return t, err
+		}
+		t = deleteTarget{ResourceType: parentType, ID: parentID}
+	}
+}
+
+// parentOf looks up a resource and returns the type and ID of its parent, or "" for patients.
+func parentOf(ctx context.Context, a *api.Api, resourceType, id string) (parentType, parentID string, err error) {
+	switch resourceType {
+	case "Instance":
+		instance, err := a.GetInstance(ctx, id)
+		return "Series", instance.ParentSeries, err
+	case "Series":
+		series, err := a.GetSeries(ctx, id)
+		return "Study", series.ParentStudy, err
+	case "Study":
+		study, err := a.GetStudy(ctx, id)
+		return "Patient", study.ParentPatient, err
+	}
+	_, err = a.GetPatient(ctx, id)
+	return "", "", err
+}
+
+func notFound(err error) bool {
+	httpErr, ok := err.(*api.HTTPError)
+	return ok && httpErr.StatusCode == 404
+}
+
+// retryPending deletes queued resources whenever the hourly limit allows, until ctx is done.
+func (d *deleteMirror) retryPending(ctx context.Context) {
+	for {
+		wait := time.Minute
+		d.serial.Lock()
+		if len(d.pending) > 0 {
+			now := time.Now()
+			if wait = d.nextAllowed(now).Sub(now); wait < time.Second {
+				wait = time.Second
+			}
+		}
+		d.serial.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		d.serial.Lock()
+		d.retry(ctx)
+		d.serial.Unlock()
+	}
+}
+
+// startDeleteRetries runs retryPending for the destinations that mirror deletions until ctx is done.
+func startDeleteRetries(ctx context.Context, dests []*cloneDest) {
+	for _, d := range dests {
+		if d.deletes != nil {
+			go d.deletes.retryPending(ctx)
+		}
+	}
+}
+
+// retry deletes queued resources as long as the hourly limit allows. d.serial must be held.
+func (d *deleteMirror) retry(ctx context.Context) {
+	for len(d.pending) > 0 && ctx.Err() == nil {
+		now := time.Now()
+		if d.nextAllowed(now).After(now) {
+			return
+		}
+		if d.apply(ctx, d.pending[0]) == deleteRateLimited {
+			return
+		}
+		d.pending = d.pending[1:]
+	}
+}
+
+// dropPending logs the deletions that are still queued when clone stops. The next clone with the
+// same delete log queues them again, see readPendingDeletions.
+func (d *deleteMirror) dropPending() {
+	d.serial.Lock()
+	defer d.serial.Unlock()
+
+	for _, t := range d.pending {
+		d.write(deletion{ResourceType: t.ResourceType, ID: t.ID, Action: deletePending})
+	}
+	if len(d.pending) > 0 {
+		next := "they are done by the next clone with this -delete-log"
+		if d.log == nil {
+			next = "use -delete-log to keep them for the next clone"
+		}
+		fmt.Fprintf(cloneLog, "%s: %d deletions not done because of -max-deletes-per-hour, %s\n", destName(d.dest), len(d.pending), next)
+	}
+	d.pending = nil
+}
+
+// readPendingDeletions returns the deletions of a delete log that are still queued, by destination
+// and in the order they were first logged. A deletion is queued if its last entry is rate-limited or
+// pending, also when clone did not stop cleanly. A missing log has none.
+func readPendingDeletions(path string) (map[string][]deleteTarget, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string][]deleteTarget{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type key struct {
+		dest   string
+		target deleteTarget
+	}
+	last := map[key]string{}
+	order := []key{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry deletion
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		k := key{entry.Destination, deleteTarget{ResourceType: entry.ResourceType, ID: entry.ID}}
+		if _, ok := last[k]; !ok {
+			order = append(order, k)
+		}
+		last[k] = entry.Action
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	pending := map[string][]deleteTarget{}
+	for _, k := range order {
+		if last[k] == deleteRateLimited || last[k] == deletePending {
+			pending[k.dest] = append(pending[k.dest], k.target)
+		}
+	}
+	return pending, nil
+}
+
+// apply deletes the resource t and logs the outcome.
+func (d *deleteMirror) apply(ctx context.Context, t deleteTarget) string {
+	entry := deletion{ResourceType: t.ResourceType, ID: t.ID}
+	entry.Action, entry.Label, entry.Error = d.delete(ctx, t.ResourceType, t.ID)
+	d.write(entry)
+	return entry.Action
+}
+
+// write logs a decision to cloneLog and the delete log.
+func (d *deleteMirror) write(entry deletion) {
+	entry.Destination = destName(d.dest)
+	entry.Time = time.Now().Format(time.RFC3339)
+
+	fmt.Fprintf(cloneLog, "delete %s %s %s %s\n", entry.Destination, entry.ResourceType, entry.ID, entry.Action)
+	if d.log != nil {
+		b, err := json.Marshal(entry)
+		if err == nil {
+			_, err = fmt.Fprintf(d.log, "%s\n", b)
+		}
+		if err != nil {
+			fmt.Fprintf(cloneLog, "delete log: %s\n", err.Error())
+		}
+	}
+}
+
+func (d *deleteMirror) delete(ctx context.Context, resourceType, id string) (action, label, errorMessage string) {
+	instances, err := d.dest.ResourceInstances(ctx, resourceType, id)
+	if notFound(err) {
+		return deleteMissing, "", ""
+	}
+	if err != nil {
+		return deleteFailed, "", err.Error()
+	}
+
+	label, err = d.protectedBy(ctx, resourceType, id)
+	if err != nil {
+		return deleteFailed, "", err.Error()
+	}
+	if label != "" {
+		return deleteProtected, label, ""
+	}
+
+	if !d.allow(time.Now()) {
+		return deleteRateLimited, "", ""
+	}
+	if d.dryRun {
+		return deleteDryRun, "", ""
+	}
+
+	err = d.dest.DeleteResource(ctx, resourceType, id)
+	if err != nil {
+		return deleteFailed, "", err.Error()
+	}
+	d.existing.Remove(instances)
+	return deleteDeleted, "", ""
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/levinalex/orthanctool/api"
+	"github.com/levinalex/orthanctool/stringset"
+)
+
+const (
+	destFailureAbort  = "abort"
+	destFailureDetach = "detach"
+)
+
+// instances up to this size are kept in memory when they are uploaded to several destinations.
+const maxSpoolInMemory = 32 << 20
+
+// apiListFlag collects the Orthanc URLs of a repeatable flag.
+type apiListFlag []*api.Api
+
+func (a *apiListFlag) Set(s string) error {
+	var f apiFlag
+	err := f.Set(s)
+	if err == nil {
+		*a = append(*a, f.Api)
+	}
+	return err
+}
+func (a apiListFlag) String() string {
+	urls := []string{}
+	for _, ap := range a {
+		urls = append(urls, ap.BaseURL.String())
+	}
+	return strings.Join(urls, ",")
+}
+
+// cloneItem is an instance waiting to be copied. If dests is set, the instance is only
+// copied to these destinations, otherwise to every destination that does not have it.
+// With archive set, the item is a whole study that is transferred as a ZIP archive instead.
+type cloneItem struct {
+	ID      string
+	dests   []*cloneDest
+	archive *studyArchive
+}
+
+// cloneDest is a single clone destination. Each destination has its own set of existing
+// instances, its own failure count and its own progress counters.
+type cloneDest struct {
+	*api.Api
+	existing stringset.Set
+	failures *failureLog
+	deletes  *deleteMirror
+	policy   string
+	label    string
+	remember bool
+	status   *componentStatus
+
+	m             sync.Mutex
+	detached      bool
+	copied        int
+	alreadyStored int
+}
+
+func newCloneDest(a *api.Api, failures io.Writer, maxFailures int, policy string) *cloneDest {
+	return &cloneDest{
+		Api:      a,
+		existing: stringset.New(),
+		failures: &failureLog{w: failures, dest: destName(a), max: maxFailures},
+		policy:   policy,
+		remember: true,
+	}
+}
+
+func (d *cloneDest) name() string { return destName(d.Api) }
+
+// destName identifies a destination by its URL without credentials, so destinations on the same host
+// with different path prefixes are kept apart.
+func destName(a *api.Api) string {
+	u := *a.BaseURL
+	u.User = nil
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+func (d *cloneDest) isDetached() bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.detached
+}
+
+// wants reports whether id still has to be copied to this destination.
+func (d *cloneDest) wants(id string) bool {
+	return !d.isDetached() && !d.existing.HasKey(id)
+}
+
+// finish records the outcome of copying id to this destination. It returns an error when
+// the whole clone has to be aborted.
+func (d *cloneDest) finish(id string, res api.PostInstanceResponse, err error) error {
+	if err == nil {
+		fmt.Fprintf(cloneLog, "copy %s%s %s\n", id, d.label, res.Status)
+		if d.remember {
+			d.existing.Add([]string{id})
+		}
+
+		instancesCopied.add(1, d.name(), res.Status)
+		d.m.Lock()
+		defer d.m.Unlock()
+		if res.Status == "AlreadyStored" {
+			d.alreadyStored++
+		} else {
+			d.copied++
+		}
+		return nil
+	}
+
+	fmt.Fprintf(cloneLog, "copy %s%s failed: %s\n", id, d.label, err.Error())
+	instancesFailed.add(1, d.name())
+	d.status.setError(fmt.Errorf("copy %s%s: %s", id, d.label, err.Error()))
+	if err := d.failures.record(err); err != nil {
+		if d.policy != destFailureDetach {
+			return err
+		}
+		d.m.Lock()
+		defer d.m.Unlock()
+		if !d.detached {
+			d.detached = true
+			fmt.Fprintf(cloneLog, "detaching destination %s: %s\n", d.name(), err.Error())
+		}
+	}
+	return nil
+}
+
+func (d *cloneDest) summary() string {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	s := fmt.Sprintf("%s: %d copied, %d already stored, %d failed", d.name(), d.copied, d.alreadyStored, d.failures.failures())
+	if d.detached {
+		s += " (detached)"
+	}
+	return s
+}
+
+// spooled holds a download so it can be uploaded more than once.
+// Small downloads are kept in memory, larger ones (or those of unknown size) in a temporary file.
+type spooled struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+func spool(r io.Reader, size int64) (*spooled, error) {
+	if size >= 0 && size <= maxSpoolInMemory {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return &spooled{data: data, size: int64(len(data))}, nil
+	}
+
+	f, err := ioutil.TempFile("", "orthanctool-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooled{file: f}
+	s.size, err = io.Copy(f, r)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func spoolInstance(ctx context.Context, source *api.Api, id string, progress *cloneProgress) (*spooled, error) {
+	r, size, err := source.InstanceFile(ctx, id)
+	if err != nil {
+		return nil, &copyError{ID: id, Stage: stageDownload, Err: err}
+	}
+	r = progress.reader(r)
+	defer r.Close()
+
+	s, err := spool(r, size)
+	if err != nil {
+		return nil, &copyError{ID: id, Stage: stageDownload, Err: err}
+	}
+	return s, nil
+}
+
+func (s *spooled) reader() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.data)
+}
+
+func (s *spooled) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// copyToDestinations copies a single instance to all destinations that do not have it yet.
+// The instance is downloaded only once, no matter how many destinations need it.
+func copyToDestinations(ctx context.Context, source *api.Api, dests []*cloneDest, item cloneItem, retries int, progress *cloneProgress) error {
+	id := item.ID
+	if item.dests != nil {
+		dests = item.dests
+	}
+
+	targets := []*cloneDest{}
+	for _, d := range dests {
+		if d.wants(id) {
+			targets = append(targets, d)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+	if len(targets) == 1 {
+		res, err := copyInstanceWithRetry(ctx, source, targets[0].Api, id, retries, progress)
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		return targets[0].finish(id, res, err)
+	}
+
+	var instance *spooled
+	err := retry(ctx, id, retries, func() (err error) {
+		instance, err = spoolInstance(ctx, source, id, progress)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		for _, d := range targets {
+			if err := d.finish(id, api.PostInstanceResponse{}, err); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer instance.Close()
+
+	for _, d := range targets {
+		var res api.PostInstanceResponse
+		err := retry(ctx, id, retries, func() (err error) {
+			res, err = uploadInstance(ctx, d.Api, id, instance.reader(), instance.size)
+			return err
+		})
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+		if err := d.finish(id, res, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeDestinations returns an error once every destination has been detached.
+func activeDestinations(dests []*cloneDest) error {
+	for _, d := range dests {
+		if !d.isDetached() {
+			return nil
+		}
+	}
+	return fmt.Errorf("all destinations detached")
+}
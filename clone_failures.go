@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	stageDownload = "download"
+	stageUpload   = "upload"
+	stageVerify   = "verify"
+)
+
+// copyError records the instance and the stage at which copying it failed.
+type copyError struct {
+	ID    string
+	Stage string
+	Err   error
+}
+
+func (e *copyError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Stage, e.ID, e.Err.Error())
+}
+
+// permanent reports whether retrying the copy is pointless.
+func (e *copyError) permanent() bool {
+	if e.Stage == stageVerify {
+		return true
+	}
+	if httpErr, ok := e.Err.(*api.HTTPError); ok {
+		return httpErr.StatusCode >= 400 && httpErr.StatusCode < 500
+	}
+	return false
+}
+
+// copyFailure is a single entry in the failure log.
+type copyFailure struct {
+	ID          string
+	Destination string `json:",omitempty"`
+	Stage       string
+	StatusCode  int `json:",omitempty"`
+	Error       string
+	Time        string
+}
+
+// failureLog counts failed instances of one destination, appends them as JSON lines to w (if set)
+// and returns an error once more than max failures have been recorded.
+type failureLog struct {
+	m     sync.Mutex
+	w     io.Writer
+	dest  string
+	max   int
+	count int
+}
+
+func (l *failureLog) record(err error) error {
+	f := copyFailure{Destination: l.dest, Error: err.Error(), Time: time.Now().Format(time.RFC3339)}
+	if cerr, ok := err.(*copyError); ok {
+		f.ID = cerr.ID
+		f.Stage = cerr.Stage
+		f.Error = cerr.Err.Error()
+		if httpErr, ok := cerr.Err.(*api.HTTPError); ok {
+			f.StatusCode = httpErr.StatusCode
+		}
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.count++
+	if l.w != nil {
+		b, jsonErr := json.Marshal(f)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		if _, writeErr := fmt.Fprintf(l.w, "%s\n", b); writeErr != nil {
+			return writeErr
+		}
+	}
+	if l.max >= 0 && l.count > l.max {
+		return fmt.Errorf("%s: too many failures (%d), last: %s", l.dest, l.count, err.Error())
+	}
+	return nil
+}
+
+func (l *failureLog) failures() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.count
+}
+
+// readFailureLog returns all entries of the failure log at path.
+func readFailureLog(path string) ([]copyFailure, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []copyFailure{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry copyFailure
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if entry.ID != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// syncWriter serializes writes of several goroutines to the same log.
+type syncWriter struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.w.Write(p)
+}
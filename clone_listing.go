@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/levinalex/orthanctool/api"
+	"github.com/levinalex/orthanctool/stringset"
+)
+
+const (
+	setBackendMemory = "memory"
+	setBackendDisk   = "disk"
+)
+
+func existingInstances(ctx context.Context, orthanc *api.Api, instanceFunc func([]string) error) error {
+	index := 0
+	for {
+		ids, err := orthanc.Instances(ctx, index, defaultInstancePageSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		err = instanceFunc(ids)
+		if err != nil {
+			return err
+		}
+		index += len(ids)
+	}
+	return nil
+}
+
+// averageInstanceSize lets progress estimate the total number of bytes from the source statistics.
+func averageInstanceSize(ctx context.Context, source *api.Api, progress *cloneProgress) {
+	if progress == nil {
+		return
+	}
+	if stats, err := source.Statistics(ctx); err == nil && stats.CountInstances > 0 {
+		progress.setAverageSize(int64(stats.TotalUncompressedSizeMB) << 20 / int64(stats.CountInstances))
+	}
+}
+
+// queueMissing lists source and destinations into memory and queues every instance
+// that is missing from at least one destination. The listing of each destination stays in
+// its existing set, which later skips instances it already has.
+func queueMissing(ctx context.Context, source *api.Api, dests []*cloneDest, queue chan<- cloneItem, progress *cloneProgress) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errors := make(chan error, 0)
+	returnError := readFirstError(errors, func() { cancel() })
+
+	instancesAtSource := stringset.New()
+	listWg := sync.WaitGroup{}
+
+	listWg.Add(1)
+	go func() {
+		defer listWg.Done()
+		defer instancesAtSource.Reset()
+
+		errors <- existingInstances(listCtx, source, instancesAtSource.Add)
+	}()
+
+	listWg.Add(len(dests))
+	for _, d := range dests {
+		go func(d *cloneDest) {
+			defer listWg.Done()
+			errors <- existingInstances(listCtx, d.Api, d.existing.Add)
+		}(d)
+	}
+
+	averageInstanceSize(listCtx, source, progress)
+	listWg.Wait()
+	close(errors)
+	if err := <-returnError; err != nil {
+		return err
+	}
+
+	wanted := func(id string) bool {
+		for _, d := range dests {
+			if d.wants(id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if progress != nil {
+		// the source listing is complete, so the number of instances missing somewhere is known
+		progress.addTotal(instancesAtSource.Count(wanted))
+	}
+
+	for id := range instancesAtSource.Drain(ctx) {
+		if !wanted(id) {
+			continue // present everywhere, not part of the progress total
+		}
+		select {
+		case queue <- cloneItem{ID: id}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// queueMissingFromDisk lists source and destinations into disk backed stores and queues
+// the instances missing from each destination by merging the sorted lists. Memory use
+// does not depend on the number of instances.
+func queueMissingFromDisk(ctx context.Context, source *api.Api, dests []*cloneDest, queue chan<- cloneItem, spillDir string, progress *cloneProgress) error {
+	stores := []*stringset.DiskStore{}
+	defer func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	}()
+	for i := 0; i <= len(dests); i++ {
+		s, err := stringset.NewDiskStore(spillDir, stringset.DefaultSpillSize)
+		if err != nil {
+			return err
+		}
+		stores = append(stores, s)
+	}
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errors := make(chan error, 0)
+	returnError := readFirstError(errors, func() { cancel() })
+
+	listWg := sync.WaitGroup{}
+	listWg.Add(len(stores))
+	for i, s := range stores {
+		orthanc := source
+		if i > 0 {
+			orthanc = dests[i-1].Api
+		}
+		go func(orthanc *api.Api, s *stringset.DiskStore) {
+			defer listWg.Done()
+			errors <- existingInstances(listCtx, orthanc, s.Add)
+		}(orthanc, s)
+	}
+
+	averageInstanceSize(listCtx, source, progress)
+	listWg.Wait()
+	close(errors)
+	if err := <-returnError; err != nil {
+		return err
+	}
+
+	difference := func(f func(string, []int) error) error {
+		iterators := []stringset.Iterator{}
+		defer func() {
+			for _, it := range iterators {
+				it.Close()
+			}
+		}()
+		for _, s := range stores {
+			it, err := s.Iterator()
+			if err != nil {
+				return err
+			}
+			iterators = append(iterators, it)
+		}
+		return stringset.Difference(iterators[0], iterators[1:], f)
+	}
+
+	if progress != nil {
+		// count first, so progress knows the total before copying starts
+		total := 0
+		err := difference(func(string, []int) error {
+			total++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		progress.addTotal(total)
+	}
+
+	return difference(func(id string, missing []int) error {
+		item := cloneItem{ID: id}
+		for _, i := range missing {
+			item.dests = append(item.dests, dests[i])
+		}
+		select {
+		case queue <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
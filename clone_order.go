@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	orderRandom  = "random"
+	orderRecent  = "recent"
+	orderOldest  = "oldest"
+	orderPatient = "patient"
+)
+
+const studyDetailPageSize = 200
+
+// cloneStudy is the part of a study needed to order the clone.
+type cloneStudy struct {
+	ID            string
+	ParentPatient string
+	LastUpdate    string
+}
+
+type studiesByLastUpdate []cloneStudy
+
+func (s studiesByLastUpdate) Len() int           { return len(s) }
+func (s studiesByLastUpdate) Less(i, j int) bool { return s[i].LastUpdate < s[j].LastUpdate }
+func (s studiesByLastUpdate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// studiesByPatient orders studies by the most recent update of their patient, then by their own update,
+// newest first. Studies of the same patient stay together.
+type studiesByPatient struct {
+	studies       []cloneStudy
+	patientUpdate map[string]string
+}
+
+func (s studiesByPatient) Len() int      { return len(s.studies) }
+func (s studiesByPatient) Swap(i, j int) { s.studies[i], s.studies[j] = s.studies[j], s.studies[i] }
+func (s studiesByPatient) Less(i, j int) bool {
+	a, b := s.studies[i], s.studies[j]
+	if a.ParentPatient != b.ParentPatient {
+		pa, pb := s.patientUpdate[a.ParentPatient], s.patientUpdate[b.ParentPatient]
+		if pa != pb {
+			return pa > pb
+		}
+		return a.ParentPatient < b.ParentPatient
+	}
+	return a.LastUpdate > b.LastUpdate
+}
+
+func sourceStudies(ctx context.Context, source *api.Api) ([]cloneStudy, error) {
+	studies := []cloneStudy{}
+	index := 0
+	for {
+		details, err := source.StudyDetailsSince(ctx, index, studyDetailPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(details) == 0 {
+			return studies, nil
+		}
+		index += len(details)
+
+		for _, d := range details {
+			studies = append(studies, cloneStudy{ID: d.ID, ParentPatient: d.ParentPatient, LastUpdate: d.LastUpdate})
+		}
+	}
+}
+
+func orderStudies(studies []cloneStudy, order string) {
+	switch order {
+	case orderRecent:
+		sort.Stable(sort.Reverse(studiesByLastUpdate(studies)))
+	case orderOldest:
+		sort.Stable(studiesByLastUpdate(studies))
+	case orderPatient:
+		patientUpdate := map[string]string{}
+		for _, s := range studies {
+			if s.LastUpdate > patientUpdate[s.ParentPatient] {
+				patientUpdate[s.ParentPatient] = s.LastUpdate
+			}
+		}
+		sort.Stable(studiesByPatient{studies, patientUpdate})
+	}
+}
+
+// studyInstances returns the instances of a study as a set, a study that does not exist is empty.
+func studyInstances(ctx context.Context, orthanc *api.Api, id string) (map[string]bool, error) {
+	ids, err := orthanc.ResourceInstances(ctx, "Study", id)
+	if httpErr, ok := err.(*api.HTTPError); ok && httpErr.StatusCode == 404 {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	instances := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		instances[id] = true
+	}
+	return instances, nil
+}
+
+// missingStudyInstances compares a single study at the source with every destination and returns
+// an item for each instance that is missing from at least one destination, as well as the number
+// of instances in the study.
+func missingStudyInstances(ctx context.Context, source *api.Api, dests []*cloneDest, id string) ([]cloneItem, int, error) {
+	ids, err := source.ResourceInstances(ctx, "Study", id)
+	if httpErr, ok := err.(*api.HTTPError); ok && httpErr.StatusCode == 404 {
+		return nil, 0, nil // deleted at the source since the study listing
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	atDest := make([]map[string]bool, len(dests))
+	for i, d := range dests {
+		if d.isDetached() {
+			continue
+		}
+		if atDest[i], err = studyInstances(ctx, d.Api, id); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	items := []cloneItem{}
+	for _, instance := range ids {
+		item := cloneItem{ID: instance}
+		for i, d := range dests {
+			if atDest[i] != nil && !atDest[i][instance] {
+				item.dests = append(item.dests, d)
+			}
+		}
+		if len(item.dests) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items, len(ids), nil
+}
+
+// estimateMissing guesses how many instances will be copied from the instance counts in the statistics.
+func estimateMissing(ctx context.Context, source *api.Api, dests []*cloneDest) int {
+	stats, err := source.Statistics(ctx)
+	if err != nil {
+		return 0
+	}
+	missing := 0
+	for _, d := range dests {
+		destStats, err := d.Statistics(ctx)
+		if err != nil {
+			return 0
+		}
+		if n := stats.CountInstances - destStats.CountInstances; n > missing {
+			missing = n
+		}
+	}
+	return missing
+}
+
+// queueMissingByStudy compares source and destinations study by study in the given order
+// and queues missing instances one study at a time. With the archive transfer mode, studies
+// that miss at least half of their instances are queued as a single item that is transferred
+// as a ZIP archive.
+func queueMissingByStudy(ctx context.Context, source *api.Api, dests []*cloneDest, queue chan<- cloneItem, order, transferMode string, progress *cloneProgress) error {
+	studies, err := sourceStudies(ctx, source)
+	if err != nil {
+		return err
+	}
+	orderStudies(studies, order)
+
+	estimate := 0
+	if progress != nil {
+		averageInstanceSize(ctx, source, progress)
+		estimate = estimateMissing(ctx, source, dests)
+		progress.addTotal(estimate)
+	}
+
+	missing := 0
+	for _, study := range studies {
+		items, total, err := missingStudyInstances(ctx, source, dests, study.ID)
+		if err != nil {
+			return err
+		}
+		missing += len(items)
+
+		if transferMode == transferArchive && len(items) > 0 && 2*len(items) >= total {
+			items = []cloneItem{{archive: &studyArchive{studyID: study.ID, items: items}}}
+		}
+
+		for _, item := range items {
+			select {
+			case queue <- item:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	// replace the estimate with the exact number
+	progress.addTotal(missing - estimate)
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	jobPollInterval = 2 * time.Second
+	// jobStallTimeout is how long a job may stay paused or waiting for a retry before it counts as failed
+	jobStallTimeout = 10 * time.Minute
+)
+
+// peerBatch is a group of studies that is sent to the peer in a single job.
+type peerBatch struct {
+	studies   []string
+	instances int
+}
+
+// peerClone lets the source send studies to one of its peers directly, so no instance data passes through orthanctool.
+// Destinations are optional. If given, they are used to skip studies that are already complete.
+type peerClone struct {
+	source      *api.Api
+	peer        string
+	accelerator bool
+	dests       []*cloneDest
+	batchSize   int
+	retries     int
+	maxFailures int
+	progress    *cloneProgress
+	status      *componentStatus
+
+	m      sync.Mutex
+	failed int
+}
+
+// studyInstanceCount returns the number of instances of a study that still have to be sent. A study
+// deleted at the source since the study listing has none.
+func (p *peerClone) studyInstanceCount(ctx context.Context, id string) (int, error) {
+	if len(p.dests) > 0 {
+		items, _, err := missingStudyInstances(ctx, p.source, p.dests, id)
+		return len(items), err
+	}
+	ids, err := p.source.ResourceInstances(ctx, "Study", id)
+	if httpErr, ok := err.(*api.HTTPError); ok && httpErr.StatusCode == 404 {
+		return 0, nil
+	}
+	return len(ids), err
+}
+
+// batches compares studies in the given order and groups those that are incomplete into batches.
+func (p *peerClone) batches(ctx context.Context, order string, batches chan<- peerBatch) error {
+	studies, err := sourceStudies(ctx, p.source)
+	if err != nil {
+		return err
+	}
+	orderStudies(studies, order)
+
+	estimate := 0
+	if p.progress != nil {
+		if stats, err := p.source.Statistics(ctx); err == nil {
+			estimate = stats.CountInstances
+		}
+		if len(p.dests) > 0 {
+			estimate = estimateMissing(ctx, p.source, p.dests)
+		}
+		p.progress.addTotal(estimate)
+	}
+
+	send := func(b peerBatch) error {
+		select {
+		case batches <- b:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	missing := 0
+	batch := peerBatch{}
+	for _, study := range studies {
+		n, err := p.studyInstanceCount(ctx, study.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		missing += n
+		batch.studies = append(batch.studies, study.ID)
+		batch.instances += n
+		if len(batch.studies) >= p.batchSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = peerBatch{}
+		}
+	}
+	if len(batch.studies) > 0 {
+		if err := send(batch); err != nil {
+			return err
+		}
+	}
+
+	// replace the estimate with the exact number
+	p.progress.addTotal(missing - estimate)
+	return nil
+}
+
+// futureStudies sends every study that becomes stable at the source. Deletions are mirrored to the destinations.
+func (p *peerClone) futureStudies(ctx context.Context, batches chan<- peerBatch, pollInterval time.Duration) error {
+	_, lastIndex, err := p.source.LastChange(ctx)
+	if err != nil {
+		return err
+	}
+
+	startDeleteRetries(ctx, p.dests)
+	p.status.watching(pollInterval)
+	return api.ChangeWatch{
+		StartIndex:   lastIndex,
+		PollInterval: pollInterval,
+		OnPoll:       p.status.polled,
+	}.Run(ctx, p.source, func(cng api.ChangeResult) {
+		defer p.status.processed(cng)
+		switch cng.ChangeType {
+		case "StableStudy":
+			ids, err := p.source.ResourceInstances(ctx, "Study", cng.ID)
+			if err != nil {
+				fmt.Fprintf(cloneLog, "study %s: %s\n", cng.ID, err.Error())
+				p.status.setError(fmt.Errorf("study %s: %s", cng.ID, err.Error()))
+				return
+			}
+			p.progress.addTotal(len(ids))
+			select {
+			case batches <- peerBatch{studies: []string{cng.ID}, instances: len(ids)}:
+			case <-ctx.Done():
+			}
+		case "Deleted":
+			for _, d := range p.dests {
+				if d.deletes != nil {
+					d.deletes.mirror(ctx, cng)
+				}
+			}
+		}
+	})
+}
+
+func (p *peerClone) submit(ctx context.Context, studies []string) (api.JobCreatedResponse, error) {
+	if !p.accelerator {
+		return p.source.StoreToPeer(ctx, p.peer, studies)
+	}
+	resources := []api.TransferResource{}
+	for _, id := range studies {
+		resources = append(resources, api.TransferResource{Level: "Study", ID: id})
+	}
+	return p.source.TransferToPeer(ctx, p.peer, resources)
+}
+
+// wait polls the job until it is done. reported holds the number of instances already counted as
+// done, it is increased as the job progresses. A job that was removed, or that is neither pending nor
+// running for longer than jobStallTimeout, fails. A stalled job is cancelled.
+func (p *peerClone) wait(ctx context.Context, jobID string, instances int, reported *int) error {
+	stalledSince := time.Time{}
+	for {
+		job, err := p.source.GetJob(ctx, jobID)
+		if notFound(err) {
+			return fmt.Errorf("job %s was removed", jobID)
+		}
+		if err != nil {
+			return err
+		}
+		if n := instances * job.Progress / 100; n > *reported {
+			p.progress.doneN(n - *reported)
+			*reported = n
+		}
+
+		switch job.State {
+		case "Success":
+			return nil
+		case "Failure":
+			return fmt.Errorf("job %s failed: %s (%d)", jobID, job.ErrorDescription, job.ErrorCode)
+		case "Pending", "Running":
+			stalledSince = time.Time{}
+		default: // Paused, Retry or unknown
+			if stalledSince.IsZero() {
+				stalledSince = time.Now()
+			}
+			if time.Since(stalledSince) > jobStallTimeout {
+				if err := p.source.CancelJob(ctx, jobID); err != nil {
+					fmt.Fprintf(cloneLog, "job %s: cancel: %s\n", jobID, err.Error())
+				}
+				return fmt.Errorf("job %s stalled in state %s for %s", jobID, job.State, jobStallTimeout)
+			}
+		}
+
+		select {
+		case <-time.After(jobPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send submits a batch as a job and waits for it, retrying failed jobs.
+// It only returns an error when more than maxFailures batches failed.
+func (p *peerClone) send(ctx context.Context, b peerBatch) error {
+	reported := 0
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		job, err := p.submit(ctx, b.studies)
+		if err == nil {
+			fmt.Fprintf(cloneLog, "job %s: sending %d studies (%d instances) to %s\n", job.ID, len(b.studies), b.instances, p.peer)
+			err = p.wait(ctx, job.ID, b.instances, &reported)
+		}
+		if err == nil {
+			fmt.Fprintf(cloneLog, "job %s: done\n", job.ID)
+			p.progress.doneN(b.instances - reported)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if attempt >= p.retries {
+			p.progress.doneN(b.instances - reported)
+			return p.fail(b, err)
+		}
+		fmt.Fprintf(cloneLog, "retry %v: %s\n", b.studies, err.Error())
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (p *peerClone) fail(b peerBatch, err error) error {
+	p.progress.fail()
+	fmt.Fprintf(cloneLog, "sending %v to %s failed: %s\n", b.studies, p.peer, err.Error())
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.failed++
+	p.status.setError(fmt.Errorf("sending %v to %s: %s", b.studies, p.peer, err.Error()))
+	if p.maxFailures >= 0 && p.failed > p.maxFailures {
+		return fmt.Errorf("%s: too many failed jobs (%d), last: %s", p.peer, p.failed, err.Error())
+	}
+	return nil
+}
+
+// runViaPeer clones by letting the source send studies to a peer instead of copying instances through this process.
+func (c *cloneCommand) runViaPeer(ctx context.Context, source *api.Api, dests []*cloneDest, progress *cloneProgress) error {
+	peers, err := source.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, peer := range peers {
+		found = found || peer == c.viaPeer
+	}
+	if !found {
+		return fmt.Errorf("peer %q is not configured at the source", c.viaPeer)
+	}
+
+	p := &peerClone{
+		source:      source,
+		peer:        c.viaPeer,
+		dests:       dests,
+		batchSize:   c.peerBatchSize,
+		retries:     c.retries,
+		maxFailures: c.maxFailures,
+		progress:    progress,
+		status:      c.status,
+	}
+	plugins, err := source.Plugins(ctx)
+	if err != nil {
+		return err
+	}
+	for _, plugin := range plugins {
+		p.accelerator = p.accelerator || plugin == "transfers"
+	}
+	if p.accelerator {
+		fmt.Fprintf(cloneLog, "using the transfers accelerator to send to %s\n", c.viaPeer)
+	}
+
+	pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
+	errors := make(chan error, 0)
+	returnError := readFirstError(errors, func() { cancel() })
+
+	batches := make(chan peerBatch, 0)
+	wg := sync.WaitGroup{}
+
+	wg.Add(c.peerJobs)
+	for i := 0; i < c.peerJobs; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case b := <-batches:
+					if err := p.send(workContext(ctx), b); err != nil {
+						errors <- err
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errors <- p.futureStudies(ctx, batches, pollInterval)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := p.batches(ctx, c.order, batches)
+		if err == nil && ctx.Err() == nil {
+			c.status.setReady()
+		}
+		errors <- err
+	}()
+
+	wg.Wait()
+	close(errors)
+	return <-returnError
+}
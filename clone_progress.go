@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cloneLog receives the log lines written by clone. While a progress bar is drawn
+// it is replaced by a writer that keeps the bar at the bottom of the terminal.
+var cloneLog io.Writer = os.Stderr
+
+const (
+	progressBar   = "bar"
+	progressLines = "lines"
+	progressJSON  = "json"
+)
+
+const progressBarWidth = 30
+
+// cloneProgress tracks how much of the initial listing (plus instances added later on) has been processed.
+type cloneProgress struct {
+	total     int64
+	processed int64
+	bytes     int64
+	failed    int64 // failures that do not belong to a single destination
+	// estimated average size of an instance at the source, 0 if unknown
+	averageSize int64
+
+	lastTime       time.Time
+	lastProcessed  int64
+	lastBytes      int64
+	bytesRate      float64
+	instancesRate  float64
+	haveRates      bool
+	destinations   []*cloneDest
+	mode           string
+	out            io.Writer
+	m              sync.Mutex
+	lastBarVisible bool
+}
+
+// progressStatus is the machine-readable progress report written with --progress-json.
+type progressStatus struct {
+	Time               string
+	Instances          int64
+	TotalInstances     int64
+	Bytes              int64
+	TotalBytes         int64 `json:",omitempty"`
+	InstancesPerSecond float64
+	BytesPerSecond     float64
+	ETASeconds         int64 `json:",omitempty"`
+	Errors             int
+	Destinations       []destinationStatus
+}
+
+type destinationStatus struct {
+	Destination   string
+	Copied        int
+	AlreadyStored int
+	Failed        int
+	Detached      bool
+}
+
+func newCloneProgress(mode string, dests []*cloneDest) *cloneProgress {
+	now := time.Now()
+	return &cloneProgress{lastTime: now, mode: mode, destinations: dests, out: os.Stderr}
+}
+
+// progressMode picks how progress is reported: JSON if requested, a bar on terminals and lines otherwise.
+func progressMode(asJSON bool) string {
+	if asJSON {
+		return progressJSON
+	}
+	// the jobs of the daemon command share stderr, a progress bar would garble their output
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && !inDaemon() {
+		return progressBar
+	}
+	return progressLines
+}
+
+func (p *cloneProgress) setAverageSize(n int64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.averageSize = n
+}
+
+func (p *cloneProgress) addTotal(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.total, int64(n))
+	}
+}
+
+func (p *cloneProgress) done() {
+	p.doneN(1)
+}
+
+func (p *cloneProgress) fail() {
+	if p != nil {
+		atomic.AddInt64(&p.failed, 1)
+	}
+}
+
+func (p *cloneProgress) doneN(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.processed, int64(n))
+	}
+}
+
+// reader counts the bytes read from r as transferred.
+func (p *cloneProgress) reader(r io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return r
+	}
+	return &countingReader{ReadCloser: r, n: &p.bytes}
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (p *cloneProgress) status(now time.Time) progressStatus {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	s := progressStatus{
+		Time:           now.Format(time.RFC3339),
+		Instances:      atomic.LoadInt64(&p.processed),
+		TotalInstances: atomic.LoadInt64(&p.total),
+		Bytes:          atomic.LoadInt64(&p.bytes),
+		Errors:         int(atomic.LoadInt64(&p.failed)),
+	}
+	if p.averageSize > 0 {
+		s.TotalBytes = s.TotalInstances * p.averageSize
+	}
+
+	if dt := now.Sub(p.lastTime).Seconds(); dt > 0 {
+		bytesRate := float64(s.Bytes-p.lastBytes) / dt
+		instancesRate := float64(s.Instances-p.lastProcessed) / dt
+		if p.haveRates {
+			// smooth rates so the ETA does not jump around
+			bytesRate = 0.3*bytesRate + 0.7*p.bytesRate
+			instancesRate = 0.3*instancesRate + 0.7*p.instancesRate
+		}
+		p.bytesRate, p.instancesRate, p.haveRates = bytesRate, instancesRate, true
+		p.lastTime, p.lastBytes, p.lastProcessed = now, s.Bytes, s.Instances
+	}
+	s.BytesPerSecond = p.bytesRate
+	s.InstancesPerSecond = p.instancesRate
+
+	if remaining := s.TotalInstances - s.Instances; remaining > 0 && p.instancesRate > 0 {
+		s.ETASeconds = int64(float64(remaining) / p.instancesRate)
+	}
+
+	for _, d := range p.destinations {
+		d.m.Lock()
+		ds := destinationStatus{
+			Destination:   d.name(),
+			Copied:        d.copied,
+			AlreadyStored: d.alreadyStored,
+			Detached:      d.detached,
+		}
+		d.m.Unlock()
+		ds.Failed = d.failures.failures()
+		s.Errors += ds.Failed
+		s.Destinations = append(s.Destinations, ds)
+	}
+	return s
+}
+
+func (s progressStatus) percent() float64 {
+	if s.TotalInstances <= 0 {
+		return 0
+	}
+	return 100 * float64(s.Instances) / float64(s.TotalInstances)
+}
+
+func (s progressStatus) String() string {
+	parts := []string{fmt.Sprintf("%d/%d instances (%.1f%%)", s.Instances, s.TotalInstances, s.percent())}
+	if s.TotalBytes > 0 {
+		parts = append(parts, fmt.Sprintf("%s of ~%s", formatBytes(s.Bytes), formatBytes(s.TotalBytes)))
+	} else {
+		parts = append(parts, formatBytes(s.Bytes))
+	}
+	parts = append(parts, formatBytes(int64(s.BytesPerSecond))+"/s", fmt.Sprintf("%.1f instances/s", s.InstancesPerSecond))
+	if s.ETASeconds > 0 {
+		parts = append(parts, "ETA "+(time.Duration(s.ETASeconds)*time.Second).String())
+	}
+	parts = append(parts, fmt.Sprintf("%d errors", s.Errors))
+	return strings.Join(parts, ", ")
+}
+
+func (s progressStatus) bar() string {
+	filled := int(s.percent() / 100 * progressBarWidth)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth-filled) + "] " + s.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (p *cloneProgress) print(now time.Time) {
+	s := p.status(now)
+	switch p.mode {
+	case progressJSON:
+		b, err := json.Marshal(s)
+		if err == nil {
+			fmt.Fprintf(p.out, "%s\n", b)
+		}
+	case progressBar:
+		p.m.Lock()
+		fmt.Fprintf(p.out, "\r\033[K%s", s.bar())
+		p.lastBarVisible = true
+		p.m.Unlock()
+	default:
+		fmt.Fprintf(p.out, "progress: %s\n", s.String())
+	}
+}
+
+// Write prints log lines above the progress bar.
+func (p *cloneProgress) Write(b []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.lastBarVisible {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.lastBarVisible = false
+	}
+	return p.out.Write(b)
+}
+
+// report prints the progress every interval until ctx is done, then prints it one last time.
+func (p *cloneProgress) report(ctx context.Context, interval time.Duration) {
+	if p.mode == progressBar {
+		interval = time.Second
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.print(now)
+		case <-ctx.Done():
+			p.print(time.Now())
+			if p.mode == progressBar {
+				p.m.Lock()
+				fmt.Fprintln(p.out)
+				p.lastBarVisible = false
+				p.m.Unlock()
+			}
+			return
+		}
+	}
+}
@@ -3,20 +3,43 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/subcommands"
 	"github.com/levinalex/orthanctool/api"
 )
 
+// maxCachedKeys limits the number of resources whose parent is remembered for -order-by.
+const maxCachedKeys = 100000
+
+var resourceLevels = map[string]int{"Patient": 1, "Study": 2, "Series": 3, "Instance": 4}
+
+// orderByLevels maps the values of -order-by to the resource type whose changes are kept in order.
+var orderByLevels = map[string]string{"resource": "", "series": "Series", "study": "Study", "patient": "Patient"}
+
 type changesCommand struct {
-	cmdArgs             []string
+	handlerOptions
+	parallelOptions
+	metricsOptions
+	handler             EventSink
+	dispatcher          *dispatcher
 	orthanc             apiFlag
 	allChanges          bool
 	filter              string
 	pollIntervalSeconds int
 	sweepSeconds        int
+	orderBy             string
+	checkpointPath      string
+	checkpoint          *checkpoint
+	resume              bool // the checkpoint file existed
+	expand              bool
+	expandTags          bool
+	handled             int64
+	status              *componentStatus
 }
 
 func ChangesCommand() *changesCommand {
@@ -25,10 +48,13 @@ func ChangesCommand() *changesCommand {
 
 func (c changesCommand) Name() string { return "changes" }
 func (c changesCommand) Usage() string {
-	return c.Name() + ` --orthanc <url> [--all] [--poll] [--sweep=<seconds>] [command...]:
+	return c.Name() + ` --orthanc <url> [--all] [--poll] [--sweep=<seconds>] [--handler-mode=exec|stream] [--parallel=N] [--checkpoint=<file>] [--expand] [--sink=<url> | command...]:
 	Iterates over changes in Orthanc.
-	Outputs each change as JSON. 
-	If command is given, it will be run for each change and JSON will be passed to it via stdin.` + "\n\n"
+	Outputs each change as JSON.
+	If command is given, it will be run for each change and JSON will be passed to it via stdin.
+	With --handler-mode=stream the command is started once and receives one JSON line per change.
+	With --checkpoint the last handled change is stored in <file> and the next run continues from there.
+	With --expand each change includes the DICOM tags of the resource and its parents.` + "\n\n"
 }
 func (c changesCommand) Synopsis() string { return "yield change entries" }
 
@@ -38,11 +64,107 @@ func (c *changesCommand) SetFlags(f *flag.FlagSet) {
 	f.BoolVar(&c.allChanges, "all", true, "yield past changes")
 	f.StringVar(&c.filter, "filter", "", "only output changes of this type")
 	f.IntVar(&c.sweepSeconds, "sweep", 0, "yield all existing instances every N seconds. 0 to disable (default). Implies -all")
+	f.StringVar(&c.orderBy, "order-by", "resource", "with -parallel, run changes of the same resource, series, study or patient in order")
+	f.StringVar(&c.checkpointPath, "checkpoint", "", "store the sequence number of the last handled change in this file and continue from it")
+	f.BoolVar(&c.expand, "expand", false, "add the MainDicomTags of the changed resource and of its parent series, study and patient to each change")
+	f.BoolVar(&c.expandTags, "expand-tags", false, "with changes of instances, also add all DICOM tags of the instance. Implies -expand")
+	c.handlerOptions.SetFlags(f)
+	c.parallelOptions.SetFlags(f)
+	c.metricsOptions.SetFlags(f)
+}
+
+// changeKeys maps changes to the resource whose changes must be handled in order.
+type changeKeys struct {
+	orthanc *api.Api
+	level   string // empty for the changed resource itself
+
+	m     sync.Mutex
+	cache map[string]parentRef // parents of series, studies and patients by ID
+}
+
+// parentRef is the parent of a resource.
+type parentRef struct {
+	resourceType string
+	id           string
+}
+
+// key walks up from the changed resource to its ancestor at k.level one level at a time. Parents
+// are cached for every resource but instances, which change only once: a burst of new instances
+// costs one lookup each for their series, the rest comes from the cache.
+func (k *changeKeys) key(ctx context.Context, event interface{}) string {
+	cng := event.(api.ChangeResult)
+	if k.level == "" {
+		return cng.ID
+	}
+
+	resourceType, id := cng.ResourceType, cng.ID
+	for resourceLevels[resourceType] > resourceLevels[k.level] {
+		k.m.Lock()
+		parent, ok := k.cache[id]
+		k.m.Unlock()
+
+		if !ok {
+			parentType, parentID, err := parentOf(ctx, k.orthanc, resourceType, id)
+			if err != nil || parentType == "" {
+				return cng.ID // deleted resources have no parent any more
+			}
+			parent = parentRef{resourceType: parentType, id: parentID}
+			if resourceType != "Instance" {
+				k.m.Lock()
+				if len(k.cache) >= maxCachedKeys {
+					k.cache = map[string]parentRef{}
+				}
+				k.cache[id] = parent
+				k.m.Unlock()
+			}
+		}
+		resourceType, id = parent.resourceType, parent.id
+	}
+	return id
+}
+
+// onChange returns the callback for a change watch. Changes of tracked watches advance the checkpoint.
+// Once the checkpoint can not be written for a while, the error is sent to errors to stop the command.
+func (c *changesCommand) onChange(ctx context.Context, tracked bool, errors chan<- error) func(api.ChangeResult) {
+	return func(cng api.ChangeResult) {
+		if ctx.Err() != nil {
+			return // shutting down, the change is handled on the next run
+		}
+		if tracked {
+			c.checkpoint.start(cng.Seq)
+		}
+		done := func(err error) {
+			atomic.AddInt64(&c.handled, 1)
+			changeLag.setProcessed(c.Name(), destName(c.orthanc.Api), cng.Seq)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "change %d (%s %s): %s\n", cng.Seq, cng.ChangeType, cng.ID, err.Error())
+				c.status.setError(fmt.Errorf("change %d (%s %s): %s", cng.Seq, cng.ChangeType, cng.ID, err.Error()))
+			}
+			c.status.processed(cng)
+			if !tracked {
+				return
+			}
+			if err := c.checkpoint.done(cng.Seq); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				c.status.setError(err)
+				if c.checkpoint.failing() {
+					errors <- err
+				}
+			}
+		}
+
+		if c.filter != "" && c.filter != cng.ChangeType {
+			done(nil)
+			return
+		}
+		c.dispatcher.dispatch(workContext(ctx), cng, done)
+	}
 }
 
 func (c *changesCommand) run(ctx context.Context) error {
 	wg := sync.WaitGroup{}
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
 	errors := make(chan error, 0)
 	returnError := readFirstError(errors, func() { cancel() })
 
@@ -50,65 +172,153 @@ func (c *changesCommand) run(ctx context.Context) error {
 	if err != nil {
 		errors <- err
 	}
+	pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
+	if pollInterval > 0 {
+		c.status.watching(pollInterval)
+	}
+
+	sweep := func() {
+		for {
+			time.Sleep(time.Duration(c.sweepSeconds) * time.Second)
+
+			errors <- api.ChangeWatch{
+				StartIndex: 0,
+				StopAtEnd:  true,
+			}.Run(ctx, c.orthanc.Api, c.onChange(ctx, false, errors))
 
-	onChange := func(cng api.ChangeResult) {
-		if c.filter == "" || c.filter == cng.ChangeType {
-			cmdAction(c.cmdArgs, cng)
+			if ctx.Err() != nil {
+				break
+			}
 		}
 	}
 
-	if c.pollIntervalSeconds > 0 {
+	if c.checkpoint != nil {
+		// a single watch, so the checkpoint can not advance past changes that were not handled yet
+		startIndex := lastIndex
+		if c.resume {
+			startIndex = c.checkpoint.saved
+		} else if c.allChanges || c.sweepSeconds > 0 {
+			startIndex = 0
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-
-			pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
 			errors <- api.ChangeWatch{
-				StartIndex:   lastIndex,
+				StartIndex:   startIndex,
+				StopAtEnd:    c.pollIntervalSeconds == 0,
 				PollInterval: pollInterval,
-			}.Run(ctx, c.orthanc.Api, onChange)
+				OnPoll: func(err error) {
+					c.status.polled(err)
+					if err == nil {
+						c.status.setReady() // caught up with the changes missed since the checkpoint
+					}
+				},
+			}.Run(ctx, c.orthanc.Api, c.onChange(ctx, true, errors))
 		}()
-	}
 
-	if c.allChanges || c.sweepSeconds > 0 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+		if c.sweepSeconds > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sweep()
+			}()
+		}
+	} else {
+		if c.pollIntervalSeconds > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-			errors <- api.ChangeWatch{
-				StartIndex: 0,
-				StopIndex:  lastIndex,
-			}.Run(ctx, c.orthanc.Api, onChange)
+				errors <- api.ChangeWatch{
+					StartIndex:   lastIndex,
+					PollInterval: pollInterval,
+					OnPoll:       c.status.polled,
+				}.Run(ctx, c.orthanc.Api, c.onChange(ctx, false, errors))
+			}()
+		}
 
-			if c.sweepSeconds > 0 {
-				for {
-					time.Sleep(time.Duration(c.sweepSeconds) * time.Second)
+		if !c.allChanges && c.sweepSeconds == 0 {
+			c.status.setReady() // there are no past changes to go through
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-					errors <- api.ChangeWatch{
-						StartIndex: 0,
-						StopAtEnd:  true,
-					}.Run(ctx, c.orthanc.Api, onChange)
+				err := api.ChangeWatch{
+					StartIndex: 0,
+					StopIndex:  lastIndex,
+				}.Run(ctx, c.orthanc.Api, c.onChange(ctx, false, errors))
+				if err == nil && ctx.Err() == nil {
+					c.status.setReady()
+				}
+				errors <- err
 
-					if ctx.Err() != nil {
-						break
-					}
+				if c.sweepSeconds > 0 {
+					sweep()
 				}
-			}
-		}()
+			}()
+		}
 	}
 
 	wg.Wait()
+	c.dispatcher.wait()
+	errors <- c.checkpoint.save()
 
 	close(errors)
 	return <-returnError
 }
 
 func (c *changesCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	c.cmdArgs = f.Args()[0:]
-	err := c.run(ctx)
+	level, ok := orderByLevels[c.orderBy]
+	if !ok {
+		return fail(fmt.Errorf("invalid -order-by %q, expected resource, series, study or patient", c.orderBy))
+	}
+	if c.checkpointPath != "" {
+		var err error
+		if c.checkpoint, c.resume, err = readCheckpoint(c.checkpointPath); err != nil {
+			return fail(err)
+		}
+	}
 
+	c.eventKind, c.orthancURL = "change", handlerURL(c.orthanc.Api)
+	handler, err := c.newSink(f.Args())
 	if err != nil {
 		return fail(err)
 	}
+	stopMetrics, err := c.startMetrics()
+	if err != nil {
+		return fail(err)
+	}
+	defer stopMetrics()
+	c.status = componentFor(ctx, c.Name())
+	c.status.setProgress(func() interface{} {
+		return map[string]int64{"handled": atomic.LoadInt64(&c.handled)}
+	})
+	if c.expand || c.expandTags {
+		handler = expandSink{EventSink: handler, expander: &changeExpander{orthanc: c.orthanc.Api, tags: c.expandTags}}
+	}
+	c.handler = handler
+	keys := &changeKeys{orthanc: c.orthanc.Api, level: level, cache: map[string]parentRef{}}
+	c.dispatcher = newDispatcher(handler, c.concurrency(c.parallel), keys.key)
+
+	err = c.run(ctx)
+	if closeErr := handler.Close(); err == nil {
+		err = closeErr
+	}
+	if sig := interrupted(ctx); sig != nil {
+		fmt.Fprintf(os.Stderr, "stopped after handling %d changes\n", c.handled)
+		if c.checkpoint != nil {
+			fmt.Fprintf(os.Stderr, "checkpoint saved at change %d\n", c.checkpoint.saved)
+		}
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
+	if err != nil {
+		c.status.setError(err)
+		return fail(err)
+	}
 	return subcommands.ExitSuccess
 }
+
+// readyAfterListing makes changes ready once it has caught up with the past changes.
+func (c *changesCommand) readyAfterListing() {}
@@ -4,118 +4,398 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/google/subcommands"
 	"github.com/levinalex/orthanctool/api"
-	"github.com/levinalex/orthanctool/stringset"
+	"github.com/levinalex/orthanctool/ratelimit"
 )
 
 const defaultInstancePageSize = 1000
 
 type cloneCommand struct {
+	metricsOptions
 	source              apiFlag
-	dest                apiFlag
+	dest                apiListFlag
 	pollIntervalSeconds int
+	maxFailures         int
+	onDestFailure       string
+	retries             int
+	failureLogPath      string
+	retryFailedPath     string
+	mirrorDeletes       bool
+	deletesDryRun       bool
+	maxDeletesPerHour   int
+	deleteLogPath       string
+	protectLabels       stringListFlag
+	progressInterval    int
+	progressJSON        bool
+	order               string
+	transferMode        string
+	viaPeer             string
+	peerBatchSize       int
+	peerJobs            int
+	setBackend          string
+	spillDir            string
+	bandwidthLimits     stringListFlag
+	requestLimits       stringListFlag
+	failureLog          io.Writer
+	deleteLog           io.Writer
+	pendingDeletes      map[string][]deleteTarget // queued by an earlier clone, by destination
+	status              *componentStatus
 }
 
 func CloneCommand() *cloneCommand { return &cloneCommand{} }
 
 func (c *cloneCommand) Name() string { return "clone" }
 func (c *cloneCommand) Usage() string {
-	return `clone --orthanc <source_url> --dest <dest_url>:
-	copy all instances from <source> at the orthanc installation at <dest>.` + "\n\n"
+	return `clone --orthanc <source_url> --dest <dest_url> [--dest <dest_url>...] [--failure-log <file>] [--retry-failed <file>] [--mirror-deletes] [--via-peer <name>]:
+	copy all instances from <source> at the orthanc installation at <dest>.
+	When --dest is given more than once, every instance is downloaded once and uploaded to all destinations.
+	With --via-peer <name> the source sends studies to its peer <name> itself, <dest> is then optional and
+	only used to skip studies that are already complete.
+	With --retry-failed only the instances listed in a previously written failure log are copied.
+	With --mirror-deletes resources deleted at <source> are also deleted at <dest>.` + "\n\n"
 }
 func (c *cloneCommand) Synopsis() string {
 	return "create a complete copy of all instances in an orthanc installation"
 }
 func (c *cloneCommand) SetFlags(f *flag.FlagSet) {
 	f.Var(&c.source, "orthanc", "source Orthanc URL")
-	f.Var(&c.dest, "dest", "destination Orthanc URL")
+	f.Var(&c.dest, "dest", "destination Orthanc URL (repeatable)")
 	f.IntVar(&c.pollIntervalSeconds, "poll", 60, "poll interval in seconds")
+	f.IntVar(&c.maxFailures, "max-failures", 0, "give up on a destination when more than N instances failed to copy. -1 for no limit")
+	f.StringVar(&c.onDestFailure, "on-dest-failure", destFailureAbort, "what to do when a destination exceeds -max-failures: abort or detach")
+	f.IntVar(&c.retries, "retries", 2, "number of times a failed instance is retried")
+	f.StringVar(&c.failureLogPath, "failure-log", "", "append failed instances as JSON lines to this file")
+	f.StringVar(&c.retryFailedPath, "retry-failed", "", "copy only the instances listed in this failure log and exit")
+	f.BoolVar(&c.mirrorDeletes, "mirror-deletes", false, "delete resources at the destination when they are deleted at the source")
+	f.BoolVar(&c.deletesDryRun, "deletes-dry-run", false, "only log deletions instead of executing them. Implies -mirror-deletes")
+	f.IntVar(&c.maxDeletesPerHour, "max-deletes-per-hour", 100, "queue deletions beyond this many per hour until the limit allows them. -1 for no limit")
+	f.StringVar(&c.deleteLogPath, "delete-log", "", "append mirrored deletions as JSON lines to this file, deletions still queued in it are done first")
+	f.Var(&c.protectLabels, "protect-label", "never delete resources carrying this label at the destination (repeatable)")
+	f.IntVar(&c.progressInterval, "progress-interval", 30, "print progress every N seconds (a progress bar is shown instead when stderr is a terminal). 0 to disable")
+	f.BoolVar(&c.progressJSON, "progress-json", false, "print progress as JSON lines")
+	f.StringVar(&c.order, "order", orderRandom, "order in which existing instances are copied: recent, oldest, patient or random")
+	f.StringVar(&c.transferMode, "transfer-mode", transferInstance, "instance: copy instance by instance. archive: copy studies as ZIP archives, falling back to instances (needs Orthanc 1.8.2 at the destination)")
+	f.StringVar(&c.viaPeer, "via-peer", "", "let the source send studies to this Orthanc peer instead of copying through this process")
+	f.IntVar(&c.peerBatchSize, "peer-batch", 10, "number of studies sent to the peer per job")
+	f.IntVar(&c.peerJobs, "peer-jobs", 2, "number of peer jobs running at the same time")
+	f.StringVar(&c.setBackend, "set-backend", setBackendMemory, "where to keep the instance lists for comparing source and destination: memory or disk")
+	f.StringVar(&c.spillDir, "spill-dir", "", "directory for the disk set backend (default: system temp directory)")
+	f.Var(&c.bandwidthLimits, "bwlimit", "limit downloads and uploads per server to this many bytes/second, e.g. 10M or 07:00-19:00=10M (repeatable)")
+	f.Var(&c.requestLimits, "rps-limit", "limit requests per server to this many per second, e.g. 20 or 07:00-19:00=20 (repeatable)")
+	c.metricsOptions.SetFlags(f)
+}
+
+// limitRates applies the --bwlimit and --rps-limit schedules to the source and all destinations.
+func (c *cloneCommand) limitRates() error {
+	var bandwidth, requests ratelimit.Schedule
+	for _, s := range c.bandwidthLimits {
+		rule, err := ratelimit.ParseByteRule(s)
+		if err != nil {
+			return err
+		}
+		bandwidth = append(bandwidth, rule)
+	}
+	for _, s := range c.requestLimits {
+		rule, err := ratelimit.ParseRule(s)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, rule)
+	}
+
+	for _, a := range append([]*api.Api{c.source.Api}, c.dest...) {
+		if len(bandwidth) > 0 {
+			a.Bandwidth = ratelimit.New(bandwidth)
+		}
+		if len(requests) > 0 {
+			a.Requests = ratelimit.New(requests)
+		}
+	}
+	return nil
 }
 
 func (c *cloneCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if c.source.Api == nil || c.dest.Api == nil {
+	if c.source.Api == nil || (len(c.dest) == 0 && c.viaPeer == "") {
 		return fail(fmt.Errorf("source or destination URL not set"))
 	}
+	if c.viaPeer != "" && (len(c.dest) > 1 || c.retryFailedPath != "") {
+		return fail(fmt.Errorf("-via-peer works with at most one -dest and without -retry-failed"))
+	}
+	if c.peerBatchSize < 1 || c.peerJobs < 1 {
+		return fail(fmt.Errorf("-peer-batch and -peer-jobs must be at least 1"))
+	}
+	if c.onDestFailure != destFailureAbort && c.onDestFailure != destFailureDetach {
+		return fail(fmt.Errorf("invalid -on-dest-failure %q", c.onDestFailure))
+	}
+	switch c.order {
+	case orderRandom, orderRecent, orderOldest, orderPatient:
+	default:
+		return fail(fmt.Errorf("invalid -order %q", c.order))
+	}
+	if c.transferMode != transferInstance && c.transferMode != transferArchive {
+		return fail(fmt.Errorf("invalid -transfer-mode %q", c.transferMode))
+	}
+	if c.setBackend != setBackendMemory && c.setBackend != setBackendDisk {
+		return fail(fmt.Errorf("invalid -set-backend %q", c.setBackend))
+	}
+	if c.setBackend == setBackendDisk && (c.order != orderRandom || c.transferMode == transferArchive) {
+		// comparing study by study only keeps a single study in memory anyway
+		return fail(fmt.Errorf("-set-backend disk works only with -order random and -transfer-mode instance"))
+	}
+	if err := c.limitRates(); err != nil {
+		return fail(err)
+	}
+	stopMetrics, err := c.startMetrics()
+	if err != nil {
+		return fail(err)
+	}
+	defer stopMetrics()
+	c.status = componentFor(ctx, c.Name())
+
+	var retryEntries []copyFailure
+	if c.retryFailedPath != "" {
+		entries, err := readFailureLog(c.retryFailedPath)
+		if err != nil {
+			return fail(err)
+		}
+		retryEntries = entries
+	}
+
+	if c.failureLogPath != "" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if c.failureLogPath == c.retryFailedPath {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		logFile, err := os.OpenFile(c.failureLogPath, flags, 0644)
+		if err != nil {
+			return fail(err)
+		}
+		defer logFile.Close()
+		c.failureLog = &syncWriter{w: logFile}
+	}
+
+	if c.deleteLogPath != "" && (c.mirrorDeletes || c.deletesDryRun) {
+		if c.pendingDeletes, err = readPendingDeletions(c.deleteLogPath); err != nil {
+			return fail(err)
+		}
+	}
+	if c.deleteLogPath != "" {
+		logFile, err := os.OpenFile(c.deleteLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fail(err)
+		}
+		defer logFile.Close()
+		c.deleteLog = &syncWriter{w: logFile}
+	}
+
+	dests := c.destinations()
+	defer func() {
+		for _, d := range dests {
+			if d.deletes != nil {
+				d.deletes.dropPending()
+			}
+			fmt.Fprintf(cloneLog, "%s\n", d.summary())
+		}
+	}()
+	c.status.setProgress(func() interface{} {
+		summaries := []string{}
+		for _, d := range dests {
+			summaries = append(summaries, d.summary())
+		}
+		return summaries
+	})
 
-	err := c.run(ctx, c.source.Api, c.dest.Api)
+	var progress *cloneProgress
+	if c.progressInterval > 0 {
+		progress = newCloneProgress(progressMode(c.progressJSON), dests)
+		if progress.mode == progressBar {
+			cloneLog = progress
+			defer func() { cloneLog = os.Stderr }()
+			c.source.Logger = log.New(progress, "", 0)
+			for _, d := range dests {
+				d.Logger = log.New(progress, "", 0)
+			}
+		}
+
+		progressCtx, stopProgress := context.WithCancel(context.Background())
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			progress.report(progressCtx, time.Duration(c.progressInterval)*time.Second)
+		}()
+		defer func() {
+			stopProgress()
+			<-progressDone
+		}()
+	}
+
+	if c.retryFailedPath != "" {
+		c.status.setReady() // there is no listing
+		err = c.retryFailed(ctx, c.source.Api, dests, retryEntries, progress)
+	} else if c.viaPeer != "" {
+		err = c.runViaPeer(ctx, c.source.Api, dests, progress)
+	} else {
+		err = c.run(ctx, c.source.Api, dests, progress)
+	}
+	if sig := interrupted(ctx); sig != nil {
+		fmt.Fprintf(cloneLog, "stopped by %s\n", sig)
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
 	if err != nil {
+		c.status.setError(err)
 		return fail(err)
 	}
 
 	return subcommands.ExitSuccess
 }
 
-func copyInstance(ctx context.Context, source, dest *api.Api, id string) (res api.PostInstanceResponse, err error) {
-	r, len, err := source.InstanceFile(ctx, id)
-	if err != nil {
-		return res, err
+// readyAfterListing makes clone ready once source and destinations are compared.
+func (c *cloneCommand) readyAfterListing() {}
+
+func (c *cloneCommand) destinations() []*cloneDest {
+	dests := []*cloneDest{}
+	for _, a := range c.dest {
+		d := newCloneDest(a, c.failureLog, c.maxFailures, c.onDestFailure)
+		// with the disk backend, copied instances are not remembered in memory either
+		d.remember = c.setBackend != setBackendDisk
+		d.status = c.status
+		if len(c.dest) > 1 {
+			d.label = " " + d.name()
+		}
+		if c.mirrorDeletes || c.deletesDryRun {
+			d.deletes = &deleteMirror{
+				source:     c.source.Api,
+				dest:       a,
+				existing:   &d.existing,
+				dryRun:     c.deletesDryRun,
+				maxPerHour: c.maxDeletesPerHour,
+				protected:  c.protectLabels,
+				log:        c.deleteLog,
+				pending:    c.pendingDeletes[destName(a)],
+			}
+			if n := len(d.deletes.pending); n > 0 {
+				fmt.Fprintf(cloneLog, "%s: %d deletions pending from the last run\n", destName(a), n)
+			}
+		}
+		dests = append(dests, d)
 	}
+	return dests
+}
+
+func uploadInstance(ctx context.Context, dest *api.Api, id string, r io.Reader, len int64) (res api.PostInstanceResponse, err error) {
 	res, err = dest.PostInstance(ctx, r, len)
 	if err != nil {
-		return res, err
+		return res, &copyError{ID: id, Stage: stageUpload, Err: err}
 	}
 	if res.ID != id {
-		return res, fmt.Errorf("instance id on destination does not match. expected %s, got %s", id, res.ID)
+		return res, &copyError{ID: id, Stage: stageVerify, Err: fmt.Errorf("instance id on destination does not match. expected %s, got %s", id, res.ID)}
 	}
 	return res, nil
 }
 
-func existingInstances(ctx context.Context, orthanc *api.Api, instanceFunc func([]string) error) error {
-	index := 0
-	for {
-		ids, err := orthanc.Instances(ctx, index, defaultInstancePageSize)
-		if err != nil {
+func copyInstance(ctx context.Context, source, dest *api.Api, id string, progress *cloneProgress) (res api.PostInstanceResponse, err error) {
+	r, len, err := source.InstanceFile(ctx, id)
+	if err != nil {
+		return res, &copyError{ID: id, Stage: stageDownload, Err: err}
+	}
+	return uploadInstance(ctx, dest, id, progress.reader(r), len)
+}
+
+// retry calls f up to retries+1 times, backing off between attempts.
+// Permanent errors are not retried.
+func retry(ctx context.Context, id string, retries int, f func() error) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= retries || ctx.Err() != nil {
 			return err
 		}
-		if len(ids) == 0 {
-			break
+		if cerr, ok := err.(*copyError); ok && cerr.permanent() {
+			return err
 		}
-		err = instanceFunc(ids)
-		if err != nil {
+		fmt.Fprintf(cloneLog, "retry %s: %s\n", id, err.Error())
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
 			return err
 		}
-		index += len(ids)
 	}
-	return nil
 }
 
-func processFutureChanges(ctx context.Context, source *api.Api, instances chan<- string, pollInterval time.Duration) error {
+// copyInstanceWithRetry calls copyInstance up to retries+1 times, backing off between attempts.
+func copyInstanceWithRetry(ctx context.Context, source, dest *api.Api, id string, retries int, progress *cloneProgress) (res api.PostInstanceResponse, err error) {
+	err = retry(ctx, id, retries, func() (err error) {
+		res, err = copyInstance(ctx, source, dest, id, progress)
+		return err
+	})
+	return res, err
+}
+
+func processFutureChanges(ctx context.Context, source *api.Api, instances chan<- cloneItem, pollInterval time.Duration, dests []*cloneDest, progress *cloneProgress, status *componentStatus) error {
 	_, lastIndex, err := source.LastChange(ctx)
 	if err != nil {
 		return err
 	}
 
+	startDeleteRetries(ctx, dests)
+	status.watching(pollInterval)
 	err = api.ChangeWatch{
 		StartIndex:   lastIndex,
 		PollInterval: pollInterval,
+		OnPoll:       status.polled,
 	}.Run(ctx, source, func(cng api.ChangeResult) {
-		if cng.ChangeType == "NewInstance" {
-			fmt.Fprintf(os.Stderr, "%v\n", cng)
-			instances <- cng.ID
+		switch cng.ChangeType {
+		case "NewInstance":
+			fmt.Fprintf(cloneLog, "%v\n", cng)
+			progress.addTotal(1)
+			select {
+			case instances <- cloneItem{ID: cng.ID}:
+			case <-ctx.Done():
+			}
+		case "Deleted":
+			for _, d := range dests {
+				if d.deletes != nil && !d.isDetached() {
+					d.deletes.mirror(ctx, cng)
+				}
+			}
 		}
+		changeLag.setProcessed("clone", destName(source), cng.Seq)
+		status.processed(cng)
 	})
 
 	return err
 }
 
-func copyInstances(ctx context.Context, source, dest *api.Api, instances <-chan string, existingInstances *stringset.Set) error {
+func copyInstances(ctx context.Context, source *api.Api, dests []*cloneDest, instances <-chan cloneItem, retries int, progress *cloneProgress) error {
 	for {
 		select {
-		case id := <-instances:
-			if existingInstances.HasKey(id) {
-				continue // skip existing instances
+		case item, ok := <-instances:
+			if !ok {
+				return nil
+			}
+			// an instance or archive that is being copied is finished on shutdown
+			var err error
+			if item.archive != nil {
+				err = copyStudyArchive(workContext(ctx), source, dests, item.archive, retries, progress)
+			} else {
+				err = copyToDestinations(workContext(ctx), source, dests, item, retries, progress)
+				progress.done()
 			}
-			res, err := copyInstance(ctx, source, dest, id)
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(os.Stderr, "copy %s %s\n", id, res.Status)
-			existingInstances.Add([]string{id})
+			if err := activeDestinations(dests); err != nil {
+				return err
+			}
 		case <-ctx.Done():
 			return nil
 		}
@@ -124,58 +404,113 @@ func copyInstances(ctx context.Context, source, dest *api.Api, instances <-chan
 
 type ErrorFunc func(err error)
 
-func (c *cloneCommand) run(ctx context.Context, source, dest *api.Api) error {
+// retryFailed copies the instances listed in a failure log once and returns an error if any of them still fail.
+// Entries that name a destination are only retried for that destination.
+func (c *cloneCommand) retryFailed(ctx context.Context, source *api.Api, dests []*cloneDest, entries []copyFailure, progress *cloneProgress) error {
 	numUploaders := 3
-	pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
 
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
 	errors := make(chan error, 0)
 	returnError := readFirstError(errors, func() { cancel() })
 
-	instancesAtDestination := stringset.New()
+	ids := []string{}
+	wanted := map[string]map[string]bool{}
+	for _, e := range entries {
+		if wanted[e.ID] == nil {
+			wanted[e.ID] = map[string]bool{}
+			ids = append(ids, e.ID)
+		}
+		wanted[e.ID][e.Destination] = true
+	}
+
+	progress.addTotal(len(ids))
 
-	instancesToCopy := make(chan string, 0)
+	instancesToCopy := make(chan cloneItem, 0)
 	wg := sync.WaitGroup{}
 
 	wg.Add(numUploaders)
 	for i := 0; i < numUploaders; i++ {
 		go func() {
 			defer wg.Done()
-			errors <- copyInstances(ctx, source, dest, instancesToCopy, &instancesAtDestination)
+			errors <- copyInstances(ctx, source, dests, instancesToCopy, c.retries, progress)
 		}()
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errors <- processFutureChanges(ctx, source, instancesToCopy, pollInterval)
-	}()
+	for _, id := range ids {
+		item := cloneItem{ID: id}
+		if !wanted[id][""] {
+			for _, d := range dests {
+				if wanted[id][d.name()] {
+					item.dests = append(item.dests, d)
+				}
+			}
+		}
+		select {
+		case instancesToCopy <- item:
+		case <-ctx.Done():
+		}
+	}
+	close(instancesToCopy)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	wg.Wait()
+	close(errors)
+	if err := <-returnError; err != nil {
+		return err
+	}
 
-		instancesAtSource := stringset.New()
+	failed := 0
+	for _, d := range dests {
+		failed += d.failures.failures()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d instances failed to copy", failed, len(ids))
+	}
+	return nil
+}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			defer instancesAtSource.Reset()
+func (c *cloneCommand) run(ctx context.Context, source *api.Api, dests []*cloneDest, progress *cloneProgress) error {
+	numUploaders := 3
+	pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
 
-			errors <- existingInstances(ctx, source, instancesAtSource.Add)
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
+	errors := make(chan error, 0)
+	returnError := readFirstError(errors, func() { cancel() })
 
+	instancesToCopy := make(chan cloneItem, 0)
+	wg := sync.WaitGroup{}
+
+	wg.Add(numUploaders)
+	for i := 0; i < numUploaders; i++ {
+		go func() {
+			defer wg.Done()
+			errors <- copyInstances(ctx, source, dests, instancesToCopy, c.retries, progress)
 		}()
+	}
 
-		errors <- existingInstances(ctx, dest, instancesAtDestination.Add)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errors <- processFutureChanges(ctx, source, instancesToCopy, pollInterval, dests, progress, c.status)
+	}()
 
-		for id := range instancesAtSource.Drain(ctx) {
-			select {
-			case instancesToCopy <- id:
-			case <-ctx.Done():
-				errors <- ctx.Err()
-				break
-			}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		switch {
+		case c.order != orderRandom || c.transferMode == transferArchive:
+			err = queueMissingByStudy(ctx, source, dests, instancesToCopy, c.order, c.transferMode, progress)
+		case c.setBackend == setBackendDisk:
+			err = queueMissingFromDisk(ctx, source, dests, instancesToCopy, c.spillDir, progress)
+		default:
+			err = queueMissing(ctx, source, dests, instancesToCopy, progress)
+		}
+		if err == nil && ctx.Err() == nil {
+			c.status.setReady()
 		}
+		errors <- err
 	}()
 
 	wg.Wait()
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// jobCommands are the commands that can run as jobs of the daemon command.
+var jobCommands = map[string]func() subcommands.Command{
+	"changes":         func() subcommands.Command { return ChangesCommand() },
+	"clone":           func() subcommands.Command { return CloneCommand() },
+	"export":          func() subcommands.Command { return ExportCommand() },
+	"import":          func() subcommands.Command { return ImportCommand() },
+	"recent-patients": func() subcommands.Command { return RecentPatientsCommand() },
+	"replay":          func() subcommands.Command { return ReplayCommand() },
+	"retention":       func() subcommands.Command { return RetentionCommand() },
+}
+
+// jobConfig is a job in the jobs section of the config file.
+type jobConfig struct {
+	Command string                 `yaml:"command"`
+	Flags   map[string]interface{} `yaml:"flags"`
+	Args    []string               `yaml:"args"` // e.g. the handler command of changes
+	// always, on-failure (default) or never
+	Restart    string        `yaml:"restart"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff"`
+}
+
+// command returns the command of job name with its flags set.
+func (j jobConfig) command(name string) (subcommands.Command, *flag.FlagSet, error) {
+	newCommand, ok := jobCommands[j.Command]
+	if !ok {
+		return nil, nil, fmt.Errorf("job %s: unknown command %q", name, j.Command)
+	}
+	cmd := newCommand()
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	cmd.SetFlags(f)
+	if err := setFlagValues(f, j.Flags, nil); err != nil {
+		return nil, nil, fmt.Errorf("job %s: %s", name, err.Error())
+	}
+	if err := f.Parse(append([]string{"--"}, j.Args...)); err != nil {
+		return nil, nil, fmt.Errorf("job %s: %s", name, err.Error())
+	}
+	if err := activeConfig.applyDefaults(j.Command, f); err != nil {
+		return nil, nil, fmt.Errorf("job %s: %s", name, err.Error())
+	}
+	return cmd, f, nil
+}
+
+// feedRegistry hands out one change feed per server.
+type feedRegistry struct {
+	m     sync.Mutex
+	feeds map[string]*api.ChangeFeed
+}
+
+// changeFeeds shares the polling of changes between the jobs of the daemon command. It is nil
+// when a single command runs.
+var changeFeeds *feedRegistry
+
+// feed returns the change feed for the server of a, or nil outside of the daemon command.
+func (r *feedRegistry) feed(a *api.Api) *api.ChangeFeed {
+	if r == nil {
+		return nil
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	key := a.BaseURL.String()
+	if r.feeds[key] == nil {
+		r.feeds[key] = api.NewChangeFeed(a)
+	}
+	return r.feeds[key]
+}
+
+// inDaemon reports whether the running command is a job of the daemon command.
+func inDaemon() bool { return changeFeeds != nil }
+
+type daemonCommand struct {
+	metricsOptions
+	configPath string
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func DaemonCommand() *daemonCommand { return &daemonCommand{} }
+
+func (c *daemonCommand) Name() string { return "daemon" }
+func (c *daemonCommand) Usage() string {
+	return c.Name() + ` [--config <file>]:
+	run the jobs defined in the jobs section of the config file in one process.
+	Each job runs a command with the given flags and is restarted with increasing delays when it fails.
+	Jobs watching the same server share the polling of its changes.` + "\n\n"
+}
+func (c *daemonCommand) Synopsis() string {
+	return "run several jobs from a config file"
+}
+func (c *daemonCommand) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.configPath, "config", "", "config file with the jobs, default the config file of orthanctool")
+	f.DurationVar(&c.backoff, "backoff", time.Second, "delay before restarting a failed job, doubled on every consecutive failure")
+	f.DurationVar(&c.maxBackoff, "max-backoff", 5*time.Minute, "maximum delay before restarting a job")
+	c.metricsOptions.SetFlags(f)
+}
+
+// execute runs cmd once. A panic in the goroutine of the job counts as a failure of the job, but
+// recover does not reach the goroutines the command starts, a panic there still stops the daemon.
+func execute(ctx context.Context, name string, cmd subcommands.Command, f *flag.FlagSet) (status subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "job %s: panic: %v\n", name, r)
+			status = subcommands.ExitFailure
+		}
+	}()
+	return cmd.Execute(ctx, f)
+}
+
+// supervise runs job name until it is done or ctx is cancelled. It returns false if the job failed
+// for good.
+func (c *daemonCommand) supervise(ctx context.Context, name string, job jobConfig) bool {
+	backoff, maxBackoff := c.backoff, c.maxBackoff
+	if job.Backoff > 0 {
+		backoff = job.Backoff
+	}
+	if job.MaxBackoff > 0 {
+		maxBackoff = job.MaxBackoff
+	}
+
+	component := newComponentStatus(name, job.Command)
+	ctx = context.WithValue(ctx, componentKey{}, component)
+	delay := backoff
+	for {
+		cmd, f, err := job.command(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			component.setError(err)
+			component.setState(stateFailed)
+			return false
+		}
+
+		fmt.Fprintf(os.Stderr, "job %s: starting %s\n", name, job.Command)
+		component.setState(stateRunning)
+		if _, ok := cmd.(readyAfterListing); !ok {
+			component.setReady()
+		}
+		started := time.Now()
+		status := execute(ctx, name, cmd, f)
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "job %s: stopped\n", name)
+			component.setState(stateFinished)
+			return true
+		}
+
+		failed := status != subcommands.ExitSuccess
+		if failed {
+			component.exited(int(status))
+		}
+		if job.Restart == restartNever || (job.Restart == restartOnFailure && !failed) {
+			fmt.Fprintf(os.Stderr, "job %s: finished with status %d\n", name, status)
+			if failed {
+				component.setState(stateFailed)
+			} else {
+				component.setState(stateFinished)
+			}
+			return !failed
+		}
+		if time.Since(started) > maxBackoff {
+			delay = backoff // it ran fine for a while, start over
+		}
+		fmt.Fprintf(os.Stderr, "job %s: exited with status %d, restarting in %s\n", name, status, delay)
+		component.setState(stateRestarting)
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(os.Stderr, "job %s: stopped\n", name)
+			return true
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+func (c *daemonCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.configPath != "" {
+		cfg, err := loadConfig(c.configPath)
+		if err != nil {
+			return fail(err)
+		}
+		for name, s := range activeConfig.Servers {
+			if _, ok := cfg.Servers[name]; !ok {
+				if cfg.Servers == nil {
+					cfg.Servers = map[string]serverConfig{}
+				}
+				cfg.Servers[name] = s
+			}
+		}
+		activeConfig = cfg
+	}
+
+	names := []string{}
+	for name, job := range activeConfig.Jobs {
+		if job.Restart == "" {
+			job.Restart = restartOnFailure
+			activeConfig.Jobs[name] = job
+		}
+		switch job.Restart {
+		case restartAlways, restartOnFailure, restartNever:
+		default:
+			return fail(fmt.Errorf("job %s: invalid restart %q, expected always, on-failure or never", name, job.Restart))
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return fail(fmt.Errorf("no jobs configured"))
+	}
+	sort.Strings(names)
+
+	changeFeeds = &feedRegistry{feeds: map[string]*api.ChangeFeed{}}
+	defer func() { changeFeeds = nil }()
+	for _, name := range names {
+		// check all jobs before starting any of them
+		if _, _, err := activeConfig.Jobs[name].command(name); err != nil {
+			return fail(err)
+		}
+	}
+
+	stopMetrics, err := c.startMetrics()
+	if err != nil {
+		return fail(err)
+	}
+	defer stopMetrics()
+
+	wg := sync.WaitGroup{}
+	m := sync.Mutex{}
+	failed := []string{}
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string, job jobConfig) {
+			defer wg.Done()
+			if !c.supervise(ctx, name, job) {
+				m.Lock()
+				failed = append(failed, name)
+				m.Unlock()
+			}
+		}(name, activeConfig.Jobs[name])
+	}
+	wg.Wait()
+
+	if interrupted(ctx) == nil && len(failed) > 0 {
+		sort.Strings(failed)
+		return fail(fmt.Errorf("failed jobs: %s", strings.Join(failed, ", ")))
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/subcommands"
+	"github.com/levinalex/orthanctool/api"
+	"github.com/levinalex/orthanctool/dicomdir"
+)
+
+type exportCommand struct {
+	orthanc      apiFlag
+	out          string
+	template     string
+	studies      stringListFlag
+	queries      stringListFlag
+	modalities   stringListFlag
+	concurrency  int
+	skipExisting bool
+	dicomdir     bool
+
+	exported, skipped, failed int64
+}
+
+func ExportCommand() *exportCommand { return &exportCommand{} }
+
+func (c *exportCommand) Name() string { return "export" }
+func (c *exportCommand) Usage() string {
+	return `export --orthanc <url> --out <dir> [--template <template>] [--study <id>...] [--query <Tag=Value>...] [--dicomdir]:
+	write instances from Orthanc as DICOM files into <dir>.
+	File names are built from main DICOM tags with <template>, e.g. ` + defaultExportTemplate + `.
+	Without --study or --query all studies are exported.` + "\n\n"
+}
+func (c *exportCommand) Synopsis() string {
+	return "export instances to a local directory tree"
+}
+func (c *exportCommand) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.orthanc, "orthanc", "Orthanc URL")
+	f.StringVar(&c.out, "out", "", "directory to write files to")
+	f.StringVar(&c.template, "template", defaultExportTemplate, "path of each file, {Tag} is replaced by a main DICOM tag of the instance, series, study or patient")
+	f.Var(&c.studies, "study", "export this Orthanc study ID (repeatable)")
+	f.Var(&c.queries, "query", "export studies matching Tag=Value, values may use wildcards and date ranges like 20200101-20201231 (repeatable, all must match)")
+	f.Var(&c.modalities, "modality", "only export series of this modality (repeatable)")
+	f.IntVar(&c.concurrency, "concurrency", 4, "number of concurrent downloads")
+	f.BoolVar(&c.skipExisting, "skip-existing", false, "do not download files that already exist")
+	f.BoolVar(&c.dicomdir, "dicomdir", false, "write a DICOMDIR. Path components are shortened to 8 characters of A-Z, 0-9 and _")
+}
+
+// exportItem is an instance together with the path it is written to.
+type exportItem struct {
+	ID   string
+	Path string // relative to the export directory, using / as separator
+	Tags map[string]string
+}
+
+func (c *exportCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.orthanc.Api == nil || c.out == "" {
+		return fail(fmt.Errorf("orthanc URL or output directory not set"))
+	}
+	if c.concurrency < 1 {
+		return fail(fmt.Errorf("-concurrency must be at least 1"))
+	}
+	query := map[string]string{}
+	for _, q := range c.queries {
+		kv := strings.SplitN(q, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fail(fmt.Errorf("invalid query %q, expected Tag=Value", q))
+		}
+		query[kv[0]] = kv[1]
+	}
+	namer, err := newExportNamer(c.template, c.dicomdir)
+	if err != nil {
+		return fail(err)
+	}
+
+	var dir *dicomdir.Dir
+	if c.dicomdir {
+		dir = dicomdir.New()
+	}
+
+	err = c.run(ctx, c.orthanc.Api, query, namer, dir)
+	fmt.Fprintf(os.Stderr, "exported %d, skipped %d existing, %d failed\n", c.exported, c.skipped, c.failed)
+	if err != nil {
+		return fail(err)
+	}
+
+	if dir != nil {
+		if err := dir.WriteFile(filepath.Join(c.out, "DICOMDIR")); err != nil {
+			return fail(err)
+		}
+	}
+	if sig := interrupted(ctx); sig != nil {
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
+	if c.failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// selectedStudies returns the IDs of the studies given with --study and those matching --query,
+// or all studies if neither is given.
+func (c *exportCommand) selectedStudies(ctx context.Context, source *api.Api, query map[string]string) ([]string, error) {
+	if len(c.studies) == 0 && len(query) == 0 {
+		studies, err := sourceStudies(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		ids := []string{}
+		for _, s := range studies {
+			ids = append(ids, s.ID)
+		}
+		return ids, nil
+	}
+
+	ids := append([]string{}, c.studies...)
+	if len(query) > 0 {
+		found, err := source.Find(ctx, "Study", query)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+	}
+	return ids, nil
+}
+
+func (c *exportCommand) wantsModality(modality string) bool {
+	if len(c.modalities) == 0 {
+		return true
+	}
+	for _, m := range c.modalities {
+		if strings.EqualFold(m, modality) {
+			return true
+		}
+	}
+	return false
+}
+
+// instancesByNumber orders instances by InstanceNumber, then by ID.
+type instancesByNumber []api.GetInstanceResponse
+
+func (s instancesByNumber) Len() int      { return len(s) }
+func (s instancesByNumber) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s instancesByNumber) Less(i, j int) bool {
+	a, _ := strconv.Atoi(s[i].MainDicomTags["InstanceNumber"])
+	b, _ := strconv.Atoi(s[j].MainDicomTags["InstanceNumber"])
+	if a != b {
+		return a < b
+	}
+	return s[i].ID < s[j].ID
+}
+
+// studyItems lists the instances of a study in a stable order and names them.
+func (c *exportCommand) studyItems(ctx context.Context, source *api.Api, id string, namer *exportNamer) ([]exportItem, error) {
+	study, err := source.GetStudy(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	series, err := source.StudySeries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []exportItem{}
+	for _, se := range series {
+		if !c.wantsModality(se.MainDicomTags["Modality"]) {
+			continue
+		}
+		instances, err := source.SeriesInstances(ctx, se.ID)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(instancesByNumber(instances))
+
+		for _, instance := range instances {
+			tags := map[string]string{}
+			for _, m := range []map[string]string{study.PatientMainDicomTags, study.MainDicomTags, se.MainDicomTags, instance.MainDicomTags} {
+				for k, v := range m {
+					tags[k] = v
+				}
+			}
+			items = append(items, exportItem{ID: instance.ID, Path: namer.name(instance.ID, tags), Tags: tags})
+		}
+	}
+	return items, nil
+}
+
+// writeInstance downloads an instance to path. The file is written under a temporary name first,
+// so an interrupted export never leaves a partial file that --skip-existing would keep.
+func writeInstance(ctx context.Context, source *api.Api, id, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	r, _, err := source.InstanceFile(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".export-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (c *exportCommand) export(ctx context.Context, source *api.Api, item exportItem, dir *dicomdir.Dir) error {
+	path := filepath.Join(c.out, filepath.FromSlash(item.Path))
+
+	_, err := os.Stat(path)
+	if c.skipExisting && err == nil {
+		atomic.AddInt64(&c.skipped, 1)
+	} else {
+		if err := writeInstance(ctx, source, item.ID, path); err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.exported, 1)
+	}
+
+	if dir != nil {
+		meta, err := dicomdir.ReadMetaFile(path)
+		if err != nil {
+			return err
+		}
+		dir.Add(item.Tags, dicomdir.Image{
+			FileID:            strings.Split(item.Path, "/"),
+			SOPClassUID:       meta.MediaStorageSOPClassUID,
+			SOPInstanceUID:    meta.MediaStorageSOPInstanceUID,
+			TransferSyntaxUID: meta.TransferSyntaxUID,
+			InstanceNumber:    item.Tags["InstanceNumber"],
+		})
+	}
+	return nil
+}
+
+func (c *exportCommand) run(ctx context.Context, source *api.Api, query map[string]string, namer *exportNamer, dir *dicomdir.Dir) error {
+	studies, err := c.selectedStudies(ctx, source, query)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
+	errors := make(chan error, 0)
+	returnError := readFirstError(errors, func() { cancel() })
+
+	items := make(chan exportItem, 0)
+	wg := sync.WaitGroup{}
+
+	wg.Add(c.concurrency)
+	for i := 0; i < c.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			// an instance that is being written is finished on shutdown
+			work := workContext(ctx)
+			for item := range items {
+				if err := c.export(work, source, item, dir); err != nil {
+					if work.Err() != nil {
+						return
+					}
+					atomic.AddInt64(&c.failed, 1)
+					fmt.Fprintf(os.Stderr, "instance %s (%s): %s\n", item.ID, item.Path, err.Error())
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(items)
+
+		seen := map[string]bool{}
+		for _, id := range studies {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			studyItems, err := c.studyItems(ctx, source, id, namer)
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				errors <- fmt.Errorf("study %s: %s", id, err.Error())
+				return
+			}
+			for _, item := range studyItems {
+				select {
+				case items <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errors)
+	return <-returnError
+}
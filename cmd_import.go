@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	importSuccess       = "Success"
+	importAlreadyStored = "AlreadyStored"
+	importFailed        = "Failed"
+)
+
+type importCommand struct {
+	orthanc     apiFlag
+	logPath     string
+	concurrency int
+	retries     int
+
+	log  io.Writer
+	done map[string]bool // files completed in a previous run
+
+	success, alreadyStored, failed, notDicom, resumed int64
+}
+
+func ImportCommand() *importCommand { return &importCommand{} }
+
+func (c *importCommand) Name() string { return "import" }
+func (c *importCommand) Usage() string {
+	return `import --orthanc <url> [--log <file>] <path>...:
+	upload all DICOM files found below <path> to Orthanc, including those inside ZIP and tar(.gz) archives.
+	Files are recognized by their DICM prefix, other files are skipped.
+	With --log every uploaded file is recorded, so a rerun with the same log skips files that are already done.` + "\n\n"
+}
+func (c *importCommand) Synopsis() string {
+	return "upload DICOM files from directories and archives"
+}
+func (c *importCommand) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.orthanc, "orthanc", "Orthanc URL")
+	f.StringVar(&c.logPath, "log", "", "append the result of each file as JSON lines to this file and skip files it lists as done")
+	f.IntVar(&c.concurrency, "concurrency", 4, "number of concurrent uploads")
+	f.IntVar(&c.retries, "retries", 2, "number of times a failed upload is retried")
+}
+
+// importEntry is a single entry in the import log.
+type importEntry struct {
+	File   string
+	Status string
+	ID     string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+	Time   string
+}
+
+// readImportLog returns the files the import log at path lists as done. A missing log is empty.
+func readImportLog(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry importEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if entry.Status == importSuccess || entry.Status == importAlreadyStored {
+			done[entry.File] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func (c *importCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.orthanc.Api == nil {
+		return fail(fmt.Errorf("orthanc URL not set"))
+	}
+	if f.NArg() == 0 {
+		return fail(fmt.Errorf("no path given"))
+	}
+	if c.concurrency < 1 {
+		return fail(fmt.Errorf("-concurrency must be at least 1"))
+	}
+
+	c.done = map[string]bool{}
+	if c.logPath != "" {
+		var err error
+		if c.done, err = readImportLog(c.logPath); err != nil {
+			return fail(err)
+		}
+		w, err := os.OpenFile(c.logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fail(err)
+		}
+		defer w.Close()
+		c.log = &syncWriter{w: w}
+	}
+
+	err := c.run(ctx, c.orthanc.Api, f.Args())
+	fmt.Fprintf(os.Stderr, "imported %d, %d already stored, %d failed, %d not DICOM, %d done in a previous run\n",
+		c.success, c.alreadyStored, c.failed, c.notDicom, c.resumed)
+	if sig := interrupted(ctx); sig != nil {
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if c.failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *importCommand) record(entry importEntry) {
+	switch entry.Status {
+	case importSuccess:
+		atomic.AddInt64(&c.success, 1)
+	case importAlreadyStored:
+		atomic.AddInt64(&c.alreadyStored, 1)
+	default:
+		atomic.AddInt64(&c.failed, 1)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", entry.File, entry.Error)
+	}
+
+	if c.log == nil {
+		return
+	}
+	entry.Time = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(entry); err == nil {
+		fmt.Fprintf(c.log, "%s\n", b)
+	}
+}
+
+func (c *importCommand) importFile(ctx context.Context, orthanc *api.Api, f importFile) {
+	defer f.finish()
+
+	if c.done[f.Name] {
+		atomic.AddInt64(&c.resumed, 1)
+		return
+	}
+	dicom, err := f.isDicom()
+	if err != nil {
+		c.record(importEntry{File: f.Name, Status: importFailed, Error: err.Error()})
+		return
+	}
+	if !dicom {
+		atomic.AddInt64(&c.notDicom, 1)
+		return
+	}
+
+	var res api.PostInstanceResponse
+	err = retry(ctx, f.Name, c.retries, func() error {
+		r, err := f.open()
+		if err != nil {
+			return err
+		}
+		res, err = orthanc.PostInstance(ctx, r, f.size)
+		if err != nil {
+			return &copyError{ID: f.Name, Stage: stageUpload, Err: err}
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		if cerr, ok := err.(*copyError); ok {
+			err = cerr.Err
+		}
+		c.record(importEntry{File: f.Name, Status: importFailed, Error: err.Error()})
+		return
+	}
+	status := importSuccess
+	if res.Status == importAlreadyStored {
+		status = importAlreadyStored
+	}
+	c.record(importEntry{File: f.Name, Status: status, ID: res.ID})
+}
+
+func (c *importCommand) run(ctx context.Context, orthanc *api.Api, paths []string) error {
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
+
+	files := make(chan importFile, 0)
+	wg := sync.WaitGroup{}
+
+	wg.Add(c.concurrency)
+	for i := 0; i < c.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				// a file that is being uploaded is finished on shutdown
+				c.importFile(workContext(ctx), orthanc, f)
+			}
+		}()
+	}
+
+	err := importFiles(ctx, paths, files, func(name string, err error) {
+		c.record(importEntry{File: name, Status: importFailed, Error: err.Error()})
+	})
+	close(files)
+	wg.Wait()
+	return err
+}
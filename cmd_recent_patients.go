@@ -4,7 +4,9 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/subcommands"
@@ -16,9 +18,15 @@ const patientDetailPageSize = 200
 const reverseChangeIteratorChunkSize = 1000
 
 type recentPatientsCommand struct {
-	cmdArgs             []string
+	handlerOptions
+	parallelOptions
+	metricsOptions
+	handler             EventSink
+	dispatcher          *dispatcher
 	orthanc             apiFlag
 	pollIntervalSeconds int
+	handled             int64
+	status              *componentStatus
 }
 
 func RecentPatientsCommand() *recentPatientsCommand {
@@ -27,10 +35,11 @@ func RecentPatientsCommand() *recentPatientsCommand {
 
 func (c *recentPatientsCommand) Name() string { return "recent-patients" }
 func (c *recentPatientsCommand) Usage() string {
-	return c.Name() + ` --orthanc <url> [command...]:
+	return c.Name() + ` --orthanc <url> [--sink=<url> | command...]:
 	Iterates over all patients stored in Orthanc roughly in most recently changed order.
 	Outputs JSON with patient ID and LastUpdate timestamp.
-	If <command> is given, it will be run for each patient and JSON will be passed to it via stdin.` + "\n\n"
+	If <command> is given, it will be run for each patient and JSON will be passed to it via stdin.
+	With --handler-mode=stream the command is started once and receives one JSON line per patient.` + "\n\n"
 }
 func (c *recentPatientsCommand) Synopsis() string {
 	return "yield patient details for most recently changed patients"
@@ -39,6 +48,9 @@ func (c *recentPatientsCommand) Synopsis() string {
 func (c *recentPatientsCommand) SetFlags(f *flag.FlagSet) {
 	f.Var(&c.orthanc, "orthanc", "Orthanc URL")
 	f.IntVar(&c.pollIntervalSeconds, "poll", 60, "poll interval in seconds. Set to 0 to disable polling)")
+	c.handlerOptions.SetFlags(f)
+	c.parallelOptions.SetFlags(f)
+	c.metricsOptions.SetFlags(f)
 }
 
 func (c *recentPatientsCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -46,16 +58,41 @@ func (c *recentPatientsCommand) Execute(ctx context.Context, f *flag.FlagSet, _
 		return fail(fmt.Errorf("orthanc URL not set"))
 	}
 
-	c.cmdArgs = f.Args()[0:]
-
-	err := c.run(ctx, c.orthanc.Api)
+	c.eventKind, c.orthancURL = "patient", handlerURL(c.orthanc.Api)
+	handler, err := c.newSink(f.Args())
+	if err != nil {
+		return fail(err)
+	}
+	stopMetrics, err := c.startMetrics()
+	if err != nil {
+		return fail(err)
+	}
+	defer stopMetrics()
+	c.status = componentFor(ctx, c.Name())
+	c.handler = handler
+	c.dispatcher = newDispatcher(handler, c.concurrency(c.parallel), func(_ context.Context, event interface{}) string {
+		return event.(patientheap.PatientOutput).ID
+	})
+
+	err = c.run(ctx, c.orthanc.Api)
+	if closeErr := handler.Close(); err == nil {
+		err = closeErr
+	}
+	if sig := interrupted(ctx); sig != nil {
+		fmt.Fprintf(os.Stderr, "stopped after handling %d patients\n", c.handled)
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
 	if err != nil {
+		c.status.setError(err)
 		return fail(err)
 	}
 
 	return subcommands.ExitSuccess
 }
 
+// readyAfterListing makes recent-patients ready once the patient list is read.
+func (c *recentPatientsCommand) readyAfterListing() {}
+
 // patientDetails iterates over all existing patients.
 func patientDetails(ctx context.Context, source *api.Api, patients chan<- patientheap.Patient) error {
 	index := 0
@@ -78,25 +115,44 @@ func patientDetails(ctx context.Context, source *api.Api, patients chan<- patien
 		}
 	}
 }
-func watchForChanges(ctx context.Context, startIndex, stopIndex int, source *api.Api, patients chan<- patientheap.Patient, pollInterval time.Duration) error {
-	return api.ChangeWatch{
+func watchForChanges(ctx context.Context, startIndex, stopIndex int, source *api.Api, patients chan<- patientheap.Patient, pollInterval time.Duration, status *componentStatus) error {
+	cw := api.ChangeWatch{
 		StartIndex:   startIndex,
 		StopIndex:    stopIndex,
 		PollInterval: pollInterval,
-	}.
+	}
+	if stopIndex < 0 {
+		status.watching(pollInterval)
+		cw.OnPoll = status.polled
+	}
+	return cw.
 		Run(ctx, source, func(cng api.ChangeResult) {
+			if stopIndex < 0 {
+				defer status.processed(cng)
+			}
 			if cng.ChangeType == "StablePatient" {
-				patients <- patientheap.Patient{ID: cng.ID, LastUpdate: cng.Date}
+				select {
+				case patients <- patientheap.Patient{ID: cng.ID, LastUpdate: cng.Date}:
+				case <-ctx.Done():
+				}
 			}
 		})
 }
 
 func (c *recentPatientsCommand) run(ctx context.Context, source *api.Api) error {
 	wg := sync.WaitGroup{}
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := withCancel(ctx)
+	defer cancel()
 	errors := make(chan error, 0)
 	patients := make(chan patientheap.Patient, 0)
-	sortedPatients := patientheap.SortPatients(ctx.Done(), patients, true)
+	queued := int64(0)
+	sortedPatients := patientheap.SortPatientsFunc(ctx.Done(), patients, true, func(n int) {
+		patientQueueLength.set(float64(n))
+		atomic.StoreInt64(&queued, int64(n))
+	})
+	c.status.setProgress(func() interface{} {
+		return map[string]int64{"handled": atomic.LoadInt64(&c.handled), "queued": atomic.LoadInt64(&queued)}
+	})
 	returnError := readFirstError(errors, func() { cancel() })
 
 	wg.Add(1)
@@ -114,21 +170,25 @@ func (c *recentPatientsCommand) run(ctx context.Context, source *api.Api) error
 			go func() {
 				defer wg.Done()
 				pollInterval := time.Duration(c.pollIntervalSeconds) * time.Second
-				errors <- watchForChanges(ctx, lastIndex, -1, source, patients, pollInterval)
+				errors <- watchForChanges(ctx, lastIndex, -1, source, patients, pollInterval, c.status)
 			}()
 		}
 
 		to := lastIndex
-		for to > 0 {
+		for to > 0 && ctx.Err() == nil {
 			from := to - reverseChangeIteratorChunkSize
-			errors <- watchForChanges(ctx, from, to, source, patients, 0) // all past changes up to now
+			errors <- watchForChanges(ctx, from, to, source, patients, 0, c.status) // all past changes up to now
 			to = from
 		}
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			errors <- patientDetails(ctx, source, patients)
+			err := patientDetails(ctx, source, patients)
+			if err == nil && ctx.Err() == nil {
+				c.status.setReady()
+			}
+			errors <- err
 		}()
 	}()
 
@@ -137,8 +197,21 @@ func (c *recentPatientsCommand) run(ctx context.Context, source *api.Api) error
 	go func() {
 		defer wg2.Done()
 		for pat := range sortedPatients {
-			errors <- cmdAction(c.cmdArgs, pat)
+			if ctx.Err() != nil {
+				continue // shutting down, drain the remaining patients
+			}
+			err := c.dispatcher.dispatch(workContext(ctx), pat, func(err error) {
+				atomic.AddInt64(&c.handled, 1)
+				if err != nil {
+					c.status.setError(fmt.Errorf("patient %s: %s", pat.ID, err.Error()))
+				}
+				errors <- err
+			})
+			if err != nil {
+				errors <- err
+			}
 		}
+		c.dispatcher.wait()
 	}()
 
 	wg.Wait()
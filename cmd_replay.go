@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/google/subcommands"
+)
+
+type replayCommand struct {
+	handlerOptions
+}
+
+func ReplayCommand() *replayCommand { return &replayCommand{} }
+
+func (c *replayCommand) Name() string { return "replay" }
+func (c *replayCommand) Usage() string {
+	return c.Name() + ` <dead-letter-file> [--sink=<url> | command...]:
+	Passes the events of a dead-letter file written by --dead-letter to the handler again.
+	Events that fail again can be collected with --dead-letter <another file>.` + "\n\n"
+}
+func (c *replayCommand) Synopsis() string {
+	return "re-run the handler for events in a dead-letter file"
+}
+
+func (c *replayCommand) SetFlags(f *flag.FlagSet) {
+	c.handlerOptions.SetFlags(f)
+}
+
+// readDeadLetters returns all entries of the dead-letter file at path.
+func readDeadLetters(path string) ([]deadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []deadLetter{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+func (c *replayCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		return fail(fmt.Errorf("dead-letter file not given"))
+	}
+	path := f.Arg(0)
+	if c.deadLetterPath != "" && sameFile(c.deadLetterPath, path) {
+		return fail(fmt.Errorf("-dead-letter must not be the file that is replayed"))
+	}
+
+	entries, err := readDeadLetters(path)
+	if err != nil {
+		return fail(err)
+	}
+	for _, entry := range entries {
+		// entries written by older versions have no kind
+		if entry.Kind != "" {
+			c.eventKind = entry.Kind
+			break
+		}
+	}
+	handler, err := c.newSink(f.Args()[1:])
+	if err != nil {
+		return fail(err)
+	}
+
+	// every entry gets its own key, order only matters within a webhook batch
+	n := 0
+	d := newDispatcher(handler, c.concurrency(1), func(context.Context, interface{}) string {
+		n++
+		return strconv.Itoa(n)
+	})
+	var m sync.Mutex
+	replayed, failed := 0, 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		err := d.dispatch(workContext(ctx), entry.Event, func(err error) {
+			m.Lock()
+			replayed++
+			if err != nil {
+				failed++
+			}
+			m.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			}
+		})
+		if err != nil {
+			break
+		}
+	}
+	d.wait()
+	if err := handler.Close(); err != nil {
+		return fail(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "replayed %d events, %d failed\n", replayed, failed)
+	if sig := interrupted(ctx); sig != nil {
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
+	if failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// orthancTimeFormat is the format of LastUpdate in Orthanc resources.
+const orthancTimeFormat = "20060102T150405"
+
+type retentionCommand struct {
+	orthanc  apiFlag
+	maxAge   time.Duration
+	interval time.Duration
+	dryRun   bool
+
+	deleted, failed int
+}
+
+func RetentionCommand() *retentionCommand { return &retentionCommand{} }
+
+func (c *retentionCommand) Name() string { return "retention" }
+func (c *retentionCommand) Usage() string {
+	return c.Name() + ` --orthanc <url> --max-age <duration> [--interval <duration>] [--dry-run]:
+	delete studies that were not updated for longer than <duration>, e.g. 2160h for 90 days.
+	With --interval the check is repeated until the command is stopped.` + "\n\n"
+}
+func (c *retentionCommand) Synopsis() string {
+	return "delete studies older than a maximum age"
+}
+func (c *retentionCommand) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.orthanc, "orthanc", "Orthanc URL")
+	f.DurationVar(&c.maxAge, "max-age", 0, "delete studies whose LastUpdate is older than this")
+	f.DurationVar(&c.interval, "interval", 0, "repeat the check at this interval. 0 to check once (default)")
+	f.BoolVar(&c.dryRun, "dry-run", false, "only print the studies that would be deleted")
+}
+
+// run deletes the studies last updated before now - maxAge.
+func (c *retentionCommand) run(ctx context.Context) error {
+	studies, err := sourceStudies(ctx, c.orthanc.Api)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().UTC().Add(-c.maxAge).Format(orthancTimeFormat)
+	for _, s := range studies {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if s.LastUpdate == "" || s.LastUpdate >= cutoff {
+			continue
+		}
+		if c.dryRun {
+			fmt.Fprintf(os.Stdout, "%s %s\n", s.ID, s.LastUpdate)
+			continue
+		}
+		if err := c.orthanc.DeleteResource(workContext(ctx), "Study", s.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "study %s: %s\n", s.ID, err.Error())
+			c.failed++
+			continue
+		}
+		c.deleted++
+	}
+	return nil
+}
+
+func (c *retentionCommand) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.orthanc.Api == nil {
+		return fail(fmt.Errorf("orthanc URL not set"))
+	}
+	if c.maxAge <= 0 {
+		return fail(fmt.Errorf("-max-age must be greater than 0"))
+	}
+
+	for {
+		if err := c.run(ctx); err != nil && ctx.Err() == nil {
+			return fail(err)
+		}
+		if c.interval == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(c.interval):
+			continue
+		}
+		break
+	}
+	if !c.dryRun {
+		fmt.Fprintf(os.Stderr, "deleted %d studies, %d failed\n", c.deleted, c.failed)
+	}
+
+	if sig := interrupted(ctx); sig != nil && c.interval == 0 {
+		return subcommands.ExitStatus(exitStatus(sig))
+	}
+	if c.failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
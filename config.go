@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/levinalex/orthanctool/api"
+	"gopkg.in/yaml.v2"
+)
+
+// configEnvPrefix starts the names of environment variables that override the config file.
+const configEnvPrefix = "ORTHANCTOOL_"
+
+// serverConfig is a named Orthanc server, used with --orthanc @name.
+type serverConfig struct {
+	URL                string        `yaml:"url"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	Timeout            time.Duration `yaml:"timeout"`
+	CAFile             string        `yaml:"ca-file"`
+	CertFile           string        `yaml:"cert-file"`
+	KeyFile            string        `yaml:"key-file"`
+	InsecureSkipVerify bool          `yaml:"insecure-skip-verify"`
+}
+
+// config is the content of the config file.
+type config struct {
+	Servers map[string]serverConfig `yaml:"servers"`
+	// default flag values per command, a list sets a repeatable flag several times
+	Commands map[string]map[string]interface{} `yaml:"commands"`
+	// jobs run by the daemon command
+	Jobs map[string]jobConfig `yaml:"jobs"`
+}
+
+// activeConfig is loaded by main before the command line of a command is parsed.
+var activeConfig = &config{}
+
+// envKey converts a name to the form used in environment variables: pacs-a becomes PACS_A.
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/orthanctool/config.yaml, by default in ~/.config.
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			u, err := user.Current()
+			if err != nil {
+				return ""
+			}
+			home = u.HomeDir
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "orthanctool", "config.yaml")
+}
+
+// loadConfig reads the config file at path, or at $ORTHANCTOOL_CONFIG or the default path if path
+// is empty. A missing file at the default path is not an error.
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		path = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+
+	c := &config{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return c, nil
+}
+
+// server returns the server with the given name. Variables like ORTHANCTOOL_SERVER_PACS_A_PASSWORD
+// override the values from the config file, a server may also be defined by variables alone.
+func (c *config) server(name string) (serverConfig, error) {
+	s, ok := c.Servers[name]
+
+	prefix := configEnvPrefix + "SERVER_" + envKey(name) + "_"
+	fields := map[string]*string{
+		"URL": &s.URL, "USERNAME": &s.Username, "PASSWORD": &s.Password,
+		"CA_FILE": &s.CAFile, "CERT_FILE": &s.CertFile, "KEY_FILE": &s.KeyFile,
+	}
+	for key, value := range fields {
+		if v, found := os.LookupEnv(prefix + key); found {
+			*value = v
+		}
+	}
+	if v, found := os.LookupEnv(prefix + "TIMEOUT"); found {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return s, fmt.Errorf("%sTIMEOUT: %s", prefix, err.Error())
+		}
+		s.Timeout = d
+	}
+	if v, found := os.LookupEnv(prefix + "INSECURE_SKIP_VERIFY"); found {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("%sINSECURE_SKIP_VERIFY: %s", prefix, err.Error())
+		}
+		s.InsecureSkipVerify = b
+	}
+
+	if s.URL == "" {
+		if !ok {
+			return s, fmt.Errorf("unknown server %q", name)
+		}
+		return s, fmt.Errorf("server %q has no url", name)
+	}
+	return s, nil
+}
+
+func (s serverConfig) tlsConfig() (*tls.Config, error) {
+	if s.CAFile == "" && s.CertFile == "" && !s.InsecureSkipVerify {
+		return nil, nil
+	}
+	t := &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify}
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", s.CAFile)
+		}
+	}
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+func (s serverConfig) api() (*api.Api, error) {
+	t, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewWithOptions(s.URL, api.Options{
+		Username:  s.Username,
+		Password:  s.Password,
+		Timeout:   s.Timeout,
+		TLSConfig: t,
+	})
+}
+
+// configValues returns the values of a flag in the config file as strings.
+func configValues(v interface{}) []string {
+	if list, ok := v.([]interface{}); ok {
+		values := []string{}
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// applyDefaults sets the flags of command that were not given on the command line, from variables
+// like ORTHANCTOOL_CHANGES_POLL or else from the commands section of the config file.
+func (c *config) applyDefaults(command string, f *flag.FlagSet) error {
+	given := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+
+	var err error
+	f.VisitAll(func(fl *flag.Flag) {
+		name := configEnvPrefix + envKey(command) + "_" + envKey(fl.Name)
+		if v, found := os.LookupEnv(name); found && !given[fl.Name] && err == nil {
+			if setErr := f.Set(fl.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %s", name, setErr.Error())
+			}
+			given[fl.Name] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := setFlagValues(f, c.Commands[command], given); err != nil {
+		return fmt.Errorf("config: %s: %s", command, err.Error())
+	}
+	return nil
+}
+
+// setFlagValues sets the flags in values from the config file, except for those in skip.
+func setFlagValues(f *flag.FlagSet, values map[string]interface{}, skip map[string]bool) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if f.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if skip[name] {
+			continue
+		}
+		for _, v := range configValues(values[name]) {
+			if err := f.Set(name, v); err != nil {
+				return fmt.Errorf("-%s: %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// configuredCommand applies the defaults from the environment and the config file before running
+// the command.
+type configuredCommand struct {
+	subcommands.Command
+}
+
+func (c configuredCommand) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if err := activeConfig.applyDefaults(c.Name(), f); err != nil {
+		return fail(err)
+	}
+	return c.Command.Execute(ctx, f, args...)
+}
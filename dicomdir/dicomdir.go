@@ -0,0 +1,462 @@
+// Package dicomdir writes DICOMDIR files (DICOM PS3.10 media storage directories) and reads
+// the file meta information of DICOM files.
+package dicomdir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	mediaStorageDirectoryStorage = "1.2.840.10008.1.3.10"
+	explicitVRLittleEndian       = "1.2.840.10008.1.2.1"
+	implementationClassUID       = "2.25.160946380287346389472375632745294851201"
+	implementationVersionName    = "ORTHANCTOOL"
+
+	preambleLength = 128
+)
+
+// Image is a DICOM file referenced by the directory.
+type Image struct {
+	// FileID is the path of the file relative to the DICOMDIR, one element per directory level.
+	// Components must be at most 8 characters of A-Z, 0-9 and _, see ValidFileID.
+	FileID            []string
+	SOPClassUID       string
+	SOPInstanceUID    string
+	TransferSyntaxUID string
+	InstanceNumber    string
+}
+
+type series struct {
+	tags   map[string]string
+	images []Image
+}
+
+type study struct {
+	tags   map[string]string
+	series []*series
+	index  map[string]*series
+}
+
+type patient struct {
+	tags    map[string]string
+	studies []*study
+	index   map[string]*study
+}
+
+// Dir collects images and writes them as a DICOMDIR. It is safe for concurrent use.
+type Dir struct {
+	m        sync.Mutex
+	patients []*patient
+	index    map[string]*patient
+}
+
+func New() *Dir {
+	return &Dir{index: map[string]*patient{}}
+}
+
+// Add adds an image. tags are the main DICOM tags of the image's patient, study and series (as returned
+// by Orthanc, keyed by tag name). Images are grouped by PatientID, StudyInstanceUID and SeriesInstanceUID.
+func (d *Dir) Add(tags map[string]string, img Image) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	p := d.index[tags["PatientID"]]
+	if p == nil {
+		p = &patient{tags: tags, index: map[string]*study{}}
+		d.index[tags["PatientID"]] = p
+		d.patients = append(d.patients, p)
+	}
+	st := p.index[tags["StudyInstanceUID"]]
+	if st == nil {
+		st = &study{tags: tags, index: map[string]*series{}}
+		p.index[tags["StudyInstanceUID"]] = st
+		p.studies = append(p.studies, st)
+	}
+	se := st.index[tags["SeriesInstanceUID"]]
+	if se == nil {
+		se = &series{tags: tags}
+		st.index[tags["SeriesInstanceUID"]] = se
+		st.series = append(st.series, se)
+	}
+	se.images = append(se.images, img)
+}
+
+// ValidFileID reports whether c can be used as a component of a referenced file ID.
+func ValidFileID(c string) bool {
+	if len(c) == 0 || len(c) > 8 {
+		return false
+	}
+	for _, r := range c {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// element is a data element in explicit VR little endian.
+type element struct {
+	tag   uint32
+	vr    string
+	value []byte
+}
+
+func (e element) long() bool {
+	switch e.vr {
+	case "OB", "OW", "SQ", "UN", "UT", "UC", "UR":
+		return true
+	}
+	return false
+}
+
+func (e element) size() int {
+	if e.long() {
+		return 12 + len(e.value)
+	}
+	return 8 + len(e.value)
+}
+
+func (e element) write(b *bytes.Buffer) {
+	binary.Write(b, binary.LittleEndian, uint16(e.tag>>16))
+	binary.Write(b, binary.LittleEndian, uint16(e.tag))
+	b.WriteString(e.vr)
+	if e.long() {
+		b.Write([]byte{0, 0})
+		binary.Write(b, binary.LittleEndian, uint32(len(e.value)))
+	} else {
+		binary.Write(b, binary.LittleEndian, uint16(len(e.value)))
+	}
+	b.Write(e.value)
+}
+
+func str(tag uint32, vr, value string) element {
+	v := []byte(value)
+	if len(v)%2 == 1 {
+		if vr == "UI" {
+			v = append(v, 0)
+		} else {
+			v = append(v, ' ')
+		}
+	}
+	return element{tag: tag, vr: vr, value: v}
+}
+
+func ul(tag uint32, value uint32) element {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, value)
+	return element{tag: tag, vr: "UL", value: v}
+}
+
+func us(tag uint32, value uint16) element {
+	v := make([]byte, 2)
+	binary.LittleEndian.PutUint16(v, value)
+	return element{tag: tag, vr: "US", value: v}
+}
+
+// record is a directory record. Its offsets are filled in once the layout of the file is known.
+type record struct {
+	typ      string
+	keys     []element // sorted by tag, after the (0004,xxxx) elements
+	children []*record
+
+	offset, next, lower uint32
+}
+
+func (r *record) elements() []element {
+	e := []element{
+		ul(0x00041400, r.next),
+		us(0x00041410, 0xffff),
+		ul(0x00041420, r.lower),
+		str(0x00041430, "CS", r.typ),
+	}
+	return append(e, r.keys...)
+}
+
+// size is the size of the record's item, including the item header.
+func (r *record) size() int {
+	n := 8
+	for _, e := range r.elements() {
+		n += e.size()
+	}
+	return n
+}
+
+func (r *record) write(b *bytes.Buffer) {
+	elements := r.elements()
+	length := r.size() - 8
+	binary.Write(b, binary.LittleEndian, uint16(0xfffe))
+	binary.Write(b, binary.LittleEndian, uint16(0xe000))
+	binary.Write(b, binary.LittleEndian, uint32(length))
+	for _, e := range elements {
+		e.write(b)
+	}
+}
+
+// tagElements returns an element for each tag, in the order given (which must be by tag).
+// Tags missing from the map are written empty.
+func tagElements(tags map[string]string, defs []tagDef) []element {
+	e := []element{}
+	for _, d := range defs {
+		e = append(e, str(d.tag, d.vr, tags[d.name]))
+	}
+	return e
+}
+
+type tagDef struct {
+	tag  uint32
+	vr   string
+	name string
+}
+
+var (
+	patientTags = []tagDef{
+		{0x00100010, "PN", "PatientName"},
+		{0x00100020, "LO", "PatientID"},
+	}
+	studyTags = []tagDef{
+		{0x00080020, "DA", "StudyDate"},
+		{0x00080030, "TM", "StudyTime"},
+		{0x00080050, "SH", "AccessionNumber"},
+		{0x00081030, "LO", "StudyDescription"},
+		{0x0020000D, "UI", "StudyInstanceUID"},
+		{0x00200010, "SH", "StudyID"},
+	}
+	seriesTags = []tagDef{
+		{0x00080060, "CS", "Modality"},
+		{0x0020000E, "UI", "SeriesInstanceUID"},
+		{0x00200011, "IS", "SeriesNumber"},
+	}
+)
+
+func (d *Dir) records() []*record {
+	patients := []*record{}
+	for _, p := range d.patients {
+		pr := &record{typ: "PATIENT", keys: tagElements(p.tags, patientTags)}
+		for _, st := range p.studies {
+			sr := &record{typ: "STUDY", keys: tagElements(st.tags, studyTags)}
+			for _, se := range st.series {
+				ser := &record{typ: "SERIES", keys: tagElements(se.tags, seriesTags)}
+				for _, img := range se.images {
+					ser.children = append(ser.children, imageRecord(img))
+				}
+				sr.children = append(sr.children, ser)
+			}
+			pr.children = append(pr.children, sr)
+		}
+		patients = append(patients, pr)
+	}
+	return patients
+}
+
+func imageRecord(img Image) *record {
+	return &record{
+		typ: "IMAGE",
+		keys: []element{
+			str(0x00041500, "CS", strings.Join(img.FileID, `\`)),
+			str(0x00041510, "UI", img.SOPClassUID),
+			str(0x00041511, "UI", img.SOPInstanceUID),
+			str(0x00041512, "UI", img.TransferSyntaxUID),
+			str(0x00200013, "IS", img.InstanceNumber),
+		},
+	}
+}
+
+// layout assigns offsets to records in depth first order, starting at offset, and links siblings and children.
+// It returns the records in file order and the offset after the last one.
+func layout(siblings []*record, offset uint32) ([]*record, uint32) {
+	ordered := []*record{}
+	for i, r := range siblings {
+		r.offset = offset
+		offset += uint32(r.size())
+		ordered = append(ordered, r)
+
+		var children []*record
+		children, offset = layout(r.children, offset)
+		if len(r.children) > 0 {
+			r.lower = r.children[0].offset
+		}
+		ordered = append(ordered, children...)
+
+		if i > 0 {
+			siblings[i-1].next = r.offset
+		}
+	}
+	return ordered, offset
+}
+
+// newUID returns a UID derived from a random UUID, as described in PS3.5 B.2.
+func newUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return "2.25." + new(big.Int).SetBytes(b).String(), nil
+}
+
+func metaHeader(instanceUID string) []byte {
+	elements := []element{
+		{tag: 0x00020001, vr: "OB", value: []byte{0, 1}},
+		str(0x00020002, "UI", mediaStorageDirectoryStorage),
+		str(0x00020003, "UI", instanceUID),
+		str(0x00020010, "UI", explicitVRLittleEndian),
+		str(0x00020012, "UI", implementationClassUID),
+		str(0x00020013, "SH", implementationVersionName),
+	}
+	length := 0
+	for _, e := range elements {
+		length += e.size()
+	}
+
+	b := &bytes.Buffer{}
+	b.Write(make([]byte, preambleLength))
+	b.WriteString("DICM")
+	ul(0x00020000, uint32(length)).write(b)
+	for _, e := range elements {
+		e.write(b)
+	}
+	return b.Bytes()
+}
+
+// WriteTo writes the DICOMDIR.
+func (d *Dir) WriteTo(w io.Writer) (int64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	uid, err := newUID()
+	if err != nil {
+		return 0, err
+	}
+	b := bytes.NewBuffer(metaHeader(uid))
+
+	roots := d.records()
+	var first, last uint32
+	head := []element{
+		str(0x00041130, "CS", ""),
+		ul(0x00041200, 0),
+		ul(0x00041202, 0),
+		us(0x00041212, 0),
+	}
+	offset := uint32(b.Len())
+	for _, e := range head {
+		offset += uint32(e.size())
+	}
+	offset += 12 // header of the directory record sequence
+
+	ordered, end := layout(roots, offset)
+	if len(roots) > 0 {
+		first, last = roots[0].offset, roots[len(roots)-1].offset
+	}
+	head[1] = ul(0x00041200, first)
+	head[2] = ul(0x00041202, last)
+	for _, e := range head {
+		e.write(b)
+	}
+
+	binary.Write(b, binary.LittleEndian, uint16(0x0004))
+	binary.Write(b, binary.LittleEndian, uint16(0x1220))
+	b.WriteString("SQ")
+	b.Write([]byte{0, 0})
+	binary.Write(b, binary.LittleEndian, end-offset)
+	for _, r := range ordered {
+		r.write(b)
+	}
+
+	// values from Orthanc are UTF-8
+	str(0x00080005, "CS", "ISO_IR 192").write(b)
+
+	return b.WriteTo(w)
+}
+
+// WriteFile writes the DICOMDIR to path.
+func (d *Dir) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := d.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// maxMetaGroupLength bounds the file meta information read by ReadMeta. Real files have a few hundred
+// bytes, a larger length comes from a file that is not DICOM.
+const maxMetaGroupLength = 64 * 1024
+
+// Meta is the part of the file meta information needed to reference a file from a DICOMDIR.
+type Meta struct {
+	MediaStorageSOPClassUID    string
+	MediaStorageSOPInstanceUID string
+	TransferSyntaxUID          string
+}
+
+// ReadMeta reads the file meta information at the start of a DICOM file.
+func ReadMeta(r io.Reader) (meta Meta, err error) {
+	header := make([]byte, preambleLength+4+12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return meta, fmt.Errorf("not a DICOM file: %s", err.Error())
+	}
+	if string(header[preambleLength:preambleLength+4]) != "DICM" {
+		return meta, fmt.Errorf("not a DICOM file: missing DICM prefix")
+	}
+	groupLength := header[preambleLength+4:]
+	if binary.LittleEndian.Uint16(groupLength) != 0x0002 || binary.LittleEndian.Uint16(groupLength[2:]) != 0x0000 {
+		return meta, fmt.Errorf("file meta information group length missing")
+	}
+
+	length := binary.LittleEndian.Uint32(groupLength[8:])
+	if length > maxMetaGroupLength {
+		return meta, fmt.Errorf("not a DICOM file: file meta information group length %d", length)
+	}
+	group := make([]byte, length)
+	if _, err := io.ReadFull(r, group); err != nil {
+		return meta, err
+	}
+	for len(group) >= 8 {
+		e := element{tag: uint32(binary.LittleEndian.Uint16(group))<<16 | uint32(binary.LittleEndian.Uint16(group[2:])), vr: string(group[4:6])}
+		var n, start int
+		if e.long() {
+			if len(group) < 12 {
+				break
+			}
+			n, start = int(binary.LittleEndian.Uint32(group[8:])), 12
+		} else {
+			n, start = int(binary.LittleEndian.Uint16(group[6:])), 8
+		}
+		if n < 0 || start+n > len(group) {
+			return meta, fmt.Errorf("file meta information is truncated")
+		}
+		value := strings.TrimRight(string(group[start:start+n]), "\x00 ")
+		switch e.tag {
+		case 0x00020002:
+			meta.MediaStorageSOPClassUID = value
+		case 0x00020003:
+			meta.MediaStorageSOPInstanceUID = value
+		case 0x00020010:
+			meta.TransferSyntaxUID = value
+		}
+		group = group[start+n:]
+	}
+	return meta, nil
+}
+
+// ReadMetaFile reads the file meta information of a DICOM file.
+func ReadMetaFile(path string) (Meta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer f.Close()
+	return ReadMeta(f)
+}
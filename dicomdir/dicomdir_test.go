@@ -0,0 +1,252 @@
+package dicomdir
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// parsedElement is an element read back from explicit VR little endian, offset is its position in the file.
+type parsedElement struct {
+	tag    uint32
+	vr     string
+	value  []byte
+	offset int
+}
+
+func (e parsedElement) String() string { return strings.TrimRight(string(e.value), "\x00 ") }
+
+func (e parsedElement) uint32() uint32 { return binary.LittleEndian.Uint32(e.value) }
+
+// parseElements reads the elements of b, which starts at offset base in the file.
+func parseElements(t *testing.T, b []byte, base int) []parsedElement {
+	elements := []parsedElement{}
+	pos := 0
+	for pos < len(b) {
+		if len(b)-pos < 8 {
+			t.Fatalf("truncated element at offset %d", base+pos)
+		}
+		e := parsedElement{
+			tag:    uint32(binary.LittleEndian.Uint16(b[pos:]))<<16 | uint32(binary.LittleEndian.Uint16(b[pos+2:])),
+			vr:     string(b[pos+4 : pos+6]),
+			offset: base + pos,
+		}
+		n, start := int(binary.LittleEndian.Uint16(b[pos+6:])), 8
+		if (element{vr: e.vr}).long() {
+			n, start = int(binary.LittleEndian.Uint32(b[pos+8:])), 12
+		}
+		if pos+start+n > len(b) {
+			t.Fatalf("element %08x at offset %d: length %d exceeds the data", e.tag, e.offset, n)
+		}
+		if n%2 != 0 {
+			t.Errorf("element %08x at offset %d has odd length %d", e.tag, e.offset, n)
+		}
+		if len(elements) > 0 && elements[len(elements)-1].tag >= e.tag {
+			t.Errorf("element %08x at offset %d is not in ascending tag order", e.tag, e.offset)
+		}
+		e.value = b[pos+start : pos+start+n]
+		elements = append(elements, e)
+		pos += start + n
+	}
+	return elements
+}
+
+// parsedRecord is an item of the directory record sequence.
+type parsedRecord struct {
+	offset   int
+	elements map[uint32]parsedElement
+}
+
+func (r parsedRecord) get(tag uint32) parsedElement { return r.elements[tag] }
+
+// parseItems reads the items of a sequence value that starts at offset base in the file.
+func parseItems(t *testing.T, b []byte, base int) []parsedRecord {
+	records := []parsedRecord{}
+	pos := 0
+	for pos < len(b) {
+		if len(b)-pos < 8 || binary.LittleEndian.Uint16(b[pos:]) != 0xfffe || binary.LittleEndian.Uint16(b[pos+2:]) != 0xe000 {
+			t.Fatalf("expected an item at offset %d", base+pos)
+		}
+		n := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		if pos+8+n > len(b) {
+			t.Fatalf("item at offset %d: length %d exceeds the sequence", base+pos, n)
+		}
+		r := parsedRecord{offset: base + pos, elements: map[uint32]parsedElement{}}
+		for _, e := range parseElements(t, b[pos+8:pos+8+n], base+pos+8) {
+			r.elements[e.tag] = e
+		}
+		records = append(records, r)
+		pos += 8 + n
+	}
+	return records
+}
+
+func image(name string) Image {
+	return Image{
+		FileID:            []string{"P1", name},
+		SOPClassUID:       "1.2.840.10008.5.1.4.1.1.2",
+		SOPInstanceUID:    "1.2.3." + name,
+		TransferSyntaxUID: explicitVRLittleEndian,
+		InstanceNumber:    "1",
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	d := New()
+	tags := func(patient, study, series string) map[string]string {
+		return map[string]string{"PatientID": patient, "PatientName": "Doe^" + patient, "StudyInstanceUID": study, "SeriesInstanceUID": series, "Modality": "CT"}
+	}
+	d.Add(tags("A", "1.1", "1.1.1"), image("I1"))
+	d.Add(tags("A", "1.1", "1.1.1"), image("I2"))
+	d.Add(tags("A", "1.1", "1.1.2"), image("I3"))
+	d.Add(tags("B", "2.1", "2.1.1"), image("I4"))
+
+	buf := &bytes.Buffer{}
+	if _, err := d.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	meta, err := ReadMeta(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.MediaStorageSOPClassUID != mediaStorageDirectoryStorage || meta.TransferSyntaxUID != explicitVRLittleEndian {
+		t.Errorf("unexpected file meta information %+v", meta)
+	}
+
+	metaStart := preambleLength + 4
+	groupLength := parseElements(t, b[metaStart:metaStart+12], metaStart)[0]
+	dataset := metaStart + 12 + int(groupLength.uint32())
+	parseElements(t, b[metaStart+12:dataset], metaStart+12)
+
+	top := map[uint32]parsedElement{}
+	for _, e := range parseElements(t, b[dataset:], dataset) {
+		top[e.tag] = e
+	}
+	sequence, ok := top[0x00041220]
+	if !ok || sequence.vr != "SQ" {
+		t.Fatalf("directory record sequence missing")
+	}
+	if end := sequence.offset + 12 + len(sequence.value); top[0x00080005].offset != end {
+		t.Errorf("sequence length: next element at %d, expected %d", top[0x00080005].offset, end)
+	}
+
+	records := parseItems(t, sequence.value, sequence.offset+12)
+	byOffset := map[uint32]parsedRecord{}
+	for _, r := range records {
+		byOffset[uint32(r.offset)] = r
+	}
+	// follow resolves a link to a record, 0 is the end of a list
+	follow := func(offset uint32) (parsedRecord, bool) {
+		if offset == 0 {
+			return parsedRecord{}, false
+		}
+		r, ok := byOffset[offset]
+		if !ok {
+			t.Fatalf("offset %d does not point to a record", offset)
+		}
+		return r, true
+	}
+	// list returns the values of tag of a list of siblings, and the records of the list
+	list := func(first uint32, tag uint32) ([]string, []parsedRecord) {
+		values, siblings := []string{}, []parsedRecord{}
+		for r, ok := follow(first); ok; r, ok = follow(r.get(0x00041400).uint32()) {
+			values = append(values, r.get(tag).String())
+			siblings = append(siblings, r)
+		}
+		return values, siblings
+	}
+
+	if len(records) != 2+2+3+4 {
+		t.Fatalf("got %d records, expected 11", len(records))
+	}
+	patientIDs, patients := list(top[0x00041200].uint32(), 0x00100020)
+	if strings.Join(patientIDs, ",") != "A,B" {
+		t.Fatalf("patients %v, expected A,B", patientIDs)
+	}
+	if last := top[0x00041202].uint32(); last != uint32(patients[1].offset) {
+		t.Errorf("last root record at %d, expected %d", last, patients[1].offset)
+	}
+
+	studyUIDs, studies := list(patients[0].get(0x00041420).uint32(), 0x0020000D)
+	if strings.Join(studyUIDs, ",") != "1.1" || studies[0].get(0x00041430).String() != "STUDY" {
+		t.Fatalf("studies of A: %v", studyUIDs)
+	}
+	seriesUIDs, series := list(studies[0].get(0x00041420).uint32(), 0x0020000E)
+	if strings.Join(seriesUIDs, ",") != "1.1.1,1.1.2" {
+		t.Fatalf("series of 1.1: %v", seriesUIDs)
+	}
+	fileIDs, images := list(series[0].get(0x00041420).uint32(), 0x00041500)
+	if strings.Join(fileIDs, ",") != `P1\I1,P1\I2` {
+		t.Fatalf("images of 1.1.1: %v", fileIDs)
+	}
+	if images[0].get(0x00041430).String() != "IMAGE" || images[0].get(0x00041420).uint32() != 0 {
+		t.Errorf("image record %v", images[0].elements)
+	}
+	if uid := images[1].get(0x00041511).String(); uid != "1.2.3.I2" {
+		t.Errorf("referenced SOP instance UID %q", uid)
+	}
+	if fileIDs, _ := list(series[1].get(0x00041420).uint32(), 0x00041500); strings.Join(fileIDs, ",") != `P1\I3` {
+		t.Errorf("images of 1.1.2: %v", fileIDs)
+	}
+
+	studyUIDs, studies = list(patients[1].get(0x00041420).uint32(), 0x0020000D)
+	seriesUIDs, series = list(studies[0].get(0x00041420).uint32(), 0x0020000E)
+	fileIDs, _ = list(series[0].get(0x00041420).uint32(), 0x00041500)
+	if strings.Join(studyUIDs, ",") != "2.1" || strings.Join(seriesUIDs, ",") != "2.1.1" || strings.Join(fileIDs, ",") != `P1\I4` {
+		t.Errorf("patient B: studies %v, series %v, images %v", studyUIDs, seriesUIDs, fileIDs)
+	}
+
+	// records follow their parent in depth first order
+	order := []string{}
+	for _, r := range records {
+		order = append(order, r.get(0x00041430).String())
+	}
+	if got := strings.Join(order, ","); got != "PATIENT,STUDY,SERIES,IMAGE,IMAGE,SERIES,IMAGE,PATIENT,STUDY,SERIES,IMAGE" {
+		t.Errorf("record order %s", got)
+	}
+}
+
+func TestWriteToEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := New().WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	metaStart := preambleLength + 4
+	groupLength := parseElements(t, b[metaStart:metaStart+12], metaStart)[0]
+	dataset := metaStart + 12 + int(groupLength.uint32())
+	for _, e := range parseElements(t, b[dataset:], dataset) {
+		if (e.tag == 0x00041200 || e.tag == 0x00041202) && e.uint32() != 0 {
+			t.Errorf("element %08x is %d in an empty directory", e.tag, e.uint32())
+		}
+		if e.tag == 0x00041220 && len(e.value) != 0 {
+			t.Errorf("directory record sequence has length %d", len(e.value))
+		}
+	}
+}
+
+func TestValidFileID(t *testing.T) {
+	for c, valid := range map[string]bool{"A1_B": true, "12345678": true, "": false, "123456789": false, "abc": false, "A-B": false} {
+		if ValidFileID(c) != valid {
+			t.Errorf("ValidFileID(%q) = %v", c, !valid)
+		}
+	}
+}
+
+func TestReadMetaRejectsLargeGroup(t *testing.T) {
+	header := make([]byte, preambleLength+4+12)
+	copy(header[preambleLength:], "DICM")
+	groupLength := header[preambleLength+4:]
+	binary.LittleEndian.PutUint16(groupLength, 0x0002)
+	copy(groupLength[4:], "UL")
+	binary.LittleEndian.PutUint16(groupLength[6:], 4)
+	binary.LittleEndian.PutUint32(groupLength[8:], 0xffffffff)
+
+	_, err := ReadMeta(bytes.NewReader(header))
+	if err == nil || !strings.HasPrefix(err.Error(), "not a DICOM file") {
+		t.Errorf("got %v, expected not a DICOM file", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/levinalex/orthanctool/dicomdir"
+)
+
+const (
+	defaultExportTemplate = "{PatientID}/{StudyDate}_{StudyDescription}/{SeriesNumber}/{InstanceNumber}.dcm"
+	missingTagValue       = "unknown"
+	maxPathComponent      = 100
+	maxDicomdirDepth      = 8
+)
+
+var templatePlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// exportNamer turns the main DICOM tags of an instance into a relative path using a template like
+// "{PatientID}/{StudyDate}/{InstanceNumber}.dcm". Every path component is sanitized on its own,
+// so tag values can not add directories or escape the export directory.
+type exportNamer struct {
+	components []string
+	dicomdir   bool
+	used       map[string]string // path -> instance ID
+}
+
+func newExportNamer(template string, dicomdir bool) (*exportNamer, error) {
+	components := strings.Split(strings.Trim(template, "/"), "/")
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." {
+			return nil, fmt.Errorf("invalid path template %q", template)
+		}
+	}
+	if dicomdir {
+		if len(components) > maxDicomdirDepth {
+			return nil, fmt.Errorf("a DICOMDIR allows at most %d directory levels", maxDicomdirDepth)
+		}
+		// file IDs in a DICOMDIR have no extension
+		last := len(components) - 1
+		components[last] = strings.TrimSuffix(components[last], path.Ext(components[last]))
+	}
+	return &exportNamer{components: components, dicomdir: dicomdir, used: map[string]string{}}, nil
+}
+
+// name returns the path for an instance. An instance whose path is already taken by another
+// instance gets a numbered path instead.
+func (n *exportNamer) name(id string, tags map[string]string) string {
+	components := make([]string, len(n.components))
+	for i, c := range n.components {
+		value := templatePlaceholder.ReplaceAllStringFunc(c, func(p string) string {
+			v := strings.TrimSpace(tags[p[1:len(p)-1]])
+			if v == "" {
+				return missingTagValue
+			}
+			return v
+		})
+		if n.dicomdir {
+			components[i] = dicomdirComponent(value)
+		} else {
+			components[i] = sanitizeComponent(value)
+		}
+	}
+
+	name := path.Join(components...)
+	for i := 2; n.used[name] != "" && n.used[name] != id; i++ {
+		last := len(components) - 1
+		if n.dicomdir {
+			suffix := strconv.Itoa(i)
+			c := components[last]
+			if len(c)+len(suffix) > 8 {
+				c = c[:8-len(suffix)]
+			}
+			name = path.Join(append(components[:last:last], c+suffix)...)
+		} else {
+			ext := path.Ext(components[last])
+			name = path.Join(append(components[:last:last], strings.TrimSuffix(components[last], ext)+"_"+strconv.Itoa(i)+ext)...)
+		}
+	}
+	n.used[name] = id
+	return name
+}
+
+// sanitizeComponent replaces characters that are unsafe in file names on common file systems.
+func sanitizeComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, strings.ContainsRune(`/\:*?"<>|`, r):
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.Trim(s, " .")
+	for len(s) > maxPathComponent {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = strings.TrimRight(s[:len(s)-size], " .")
+	}
+	if s == "" {
+		return missingTagValue
+	}
+	return s
+}
+
+// dicomdirComponent converts s to a valid DICOMDIR file ID component: at most 8 characters of A-Z, 0-9 and _.
+func dicomdirComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > 8 {
+		s = s[:8]
+	}
+	if !dicomdir.ValidFileID(s) {
+		return "UNKNOWN"
+	}
+	return s
+}
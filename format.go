@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	formatJSON     = "json"
+	formatPretty   = "pretty"
+	formatCSV      = "csv"
+	formatTSV      = "tsv"
+	formatTemplate = "template"
+)
+
+// formatOptions are the flags selecting how events printed to stdout are formatted.
+type formatOptions struct {
+	format   string
+	template string
+	columns  string
+}
+
+func (o *formatOptions) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&o.format, "format", formatJSON, "format of events printed to stdout: json (one line per event), pretty, csv, tsv or template")
+	f.StringVar(&o.template, "template", "", "with -format=template, Go template printed for every event, e.g. '{{.ChangeType}} {{.ID}}'")
+	f.StringVar(&o.columns, "columns", "", "with -format=csv or tsv, comma separated columns. Nested fields are joined with dots, e.g. MainDicomTags.PatientID. Defaults to all fields of the first event")
+}
+
+// isDefault reports whether events are printed as JSON lines, the only format other sinks use.
+func (o *formatOptions) isDefault() bool {
+	return o.format == formatJSON && o.template == "" && o.columns == ""
+}
+
+// newEventWriter returns a writer printing events to w in the selected format.
+func (o *formatOptions) newEventWriter(w io.Writer) (*eventWriter, error) {
+	format := o.format
+	if format == formatJSON && o.template != "" {
+		format = formatTemplate
+	}
+	ew := &eventWriter{w: w, format: format}
+
+	switch format {
+	case formatJSON, formatPretty:
+	case formatCSV, formatTSV:
+		ew.csv = csv.NewWriter(w)
+		if format == formatTSV {
+			ew.csv.Comma = '\t'
+		}
+		if o.columns != "" {
+			ew.columns = strings.Split(o.columns, ",")
+		}
+	case formatTemplate:
+		if o.template == "" {
+			return nil, fmt.Errorf("-format=%s needs -template", format)
+		}
+		t, err := template.New("event").Option("missingkey=zero").Parse(o.template)
+		if err != nil {
+			return nil, err
+		}
+		ew.tmpl = t
+	default:
+		return nil, fmt.Errorf("invalid -format %q", o.format)
+	}
+	if o.columns != "" && ew.csv == nil {
+		return nil, fmt.Errorf("-columns needs -format=csv or tsv")
+	}
+	return ew, nil
+}
+
+// eventWriter prints events in one of the formats. It is safe for concurrent use.
+type eventWriter struct {
+	w      io.Writer
+	format string
+	tmpl   *template.Template
+
+	m       sync.Mutex
+	csv     *csv.Writer
+	columns []string // csv columns, set from the first event if not given
+	header  bool     // whether the csv header was written
+}
+
+func (ew *eventWriter) write(event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ew.m.Lock()
+	defer ew.m.Unlock()
+	switch ew.format {
+	case formatPretty:
+		var out bytes.Buffer
+		if err := json.Indent(&out, b, "", "  "); err != nil {
+			return err
+		}
+		out.WriteByte('\n')
+		_, err = ew.w.Write(out.Bytes())
+	case formatCSV, formatTSV:
+		err = ew.writeRecord(b)
+	case formatTemplate:
+		err = ew.writeTemplate(b)
+	default:
+		_, err = fmt.Fprintf(ew.w, "%s\n", b)
+	}
+	return err
+}
+
+func (ew *eventWriter) writeRecord(b []byte) error {
+	keys, values, err := flattenJSON(b)
+	if err != nil {
+		return err
+	}
+	if !ew.header {
+		if ew.columns == nil {
+			ew.columns = keys
+		}
+		if err := ew.csv.Write(ew.columns); err != nil {
+			return err
+		}
+		ew.header = true
+	}
+	record := make([]string, len(ew.columns))
+	for i, c := range ew.columns {
+		record[i] = values[c]
+	}
+	if err := ew.csv.Write(record); err != nil {
+		return err
+	}
+	ew.csv.Flush()
+	return ew.csv.Error()
+}
+
+// decodeEvent decodes a JSON event for use as template data. Numbers are kept as they are instead
+// of being converted to float64.
+func decodeEvent(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var data interface{}
+	err := dec.Decode(&data)
+	return data, err
+}
+
+func (ew *eventWriter) writeTemplate(b []byte) error {
+	data, err := decodeEvent(b)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := ew.tmpl.Execute(&out, data); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = ew.w.Write(out.Bytes())
+	return err
+}
+
+// flattenJSON returns the fields of a JSON document in the order they appear. Nested objects and
+// arrays are flattened into keys like "MainDicomTags.PatientID" or "Instances.0".
+func flattenJSON(b []byte) ([]string, map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	f := &flatJSON{values: map[string]string{}}
+	if err := f.value(dec, ""); err != nil {
+		return nil, nil, err
+	}
+	return f.keys, f.values, nil
+}
+
+type flatJSON struct {
+	keys   []string
+	values map[string]string
+}
+
+func (f *flatJSON) set(key, value string) {
+	if _, ok := f.values[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.values[key] = value
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func (f *flatJSON) value(dec *json.Decoder, prefix string) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		for i := 0; dec.More(); i++ {
+			key := strconv.Itoa(i)
+			if t == '{' {
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key = k.(string)
+			}
+			if err := f.value(dec, joinKey(prefix, key)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token() // closing delimiter
+		return err
+	case string:
+		f.set(prefix, t)
+	case json.Number:
+		f.set(prefix, t.String())
+	case bool:
+		f.set(prefix, strconv.FormatBool(t))
+	case nil:
+		f.set(prefix, "")
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	handlerModeExec   = "exec"
+	handlerModeStream = "stream"
+
+	// stderrTailSize is how much of a failed handler's stderr is kept for the error
+	stderrTailSize = 2048
+)
+
+// handlerError is returned when the handler fails to process an event.
+type handlerError struct {
+	ExitCode int    // 0 if the handler did not exit
+	Stderr   string // the end of the handler's stderr
+	Err      error
+}
+
+func (e *handlerError) Error() string {
+	return fmt.Sprintf("handler: %s", e.Err.Error())
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = t.b[len(t.b)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.b) }
+
+// handlerOptions are the flags shared by commands that pass events to a sink or a handler command.
+type handlerOptions struct {
+	formatOptions
+
+	mode           string
+	acks           bool
+	retries        int
+	backoff        time.Duration
+	deadLetterPath string
+	timeout        time.Duration
+	grace          time.Duration
+	sinkURL        string
+
+	// set by the command, not flags
+	eventKind  string // names the ORTHANC_<KIND>_* variables
+	orthancURL string
+
+	webhookURL       string
+	webhookHeaders   stringListFlag
+	webhookSecret    string
+	webhookTimeout   time.Duration
+	webhookBatch     int
+	webhookBatchWait time.Duration
+}
+
+func (o *handlerOptions) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&o.mode, "handler-mode", handlerModeExec, "exec: run the command once per event. stream: run the command once and write events to its stdin as JSON lines")
+	f.BoolVar(&o.acks, "handler-acks", false, "in stream mode, wait for the command to acknowledge each event with a line on stdout")
+	f.IntVar(&o.retries, "handler-retries", 0, "number of times the handler is retried for a failed event")
+	f.DurationVar(&o.backoff, "handler-backoff", time.Second, "delay before the first retry, doubled for each further retry")
+	f.DurationVar(&o.timeout, "handler-timeout", 0, "stop a handler that runs longer than this for an event. In stream mode, restart the command if it does not acknowledge an event in time. 0 for no timeout")
+	f.DurationVar(&o.grace, "handler-grace", 5*time.Second, "time a handler has to exit after SIGTERM before it is killed")
+	f.StringVar(&o.deadLetterPath, "dead-letter", "", "append events that failed after all retries as JSON lines to this file")
+	f.StringVar(&o.sinkURL, "sink", "", "send events to this URL instead of running a command: stdout:, file:///path[?max-size=100M&max-files=5], unix:///path, http(s)://..., sqlite:///path[?table=events] (only in builds with cgo)")
+	f.StringVar(&o.webhookURL, "webhook", "", "POST events as JSON to this URL instead of running a command, same as -sink with an http(s) URL")
+	f.Var(&o.webhookHeaders, "webhook-header", "header added to webhook requests, as \"Name: value\". Can be repeated")
+	f.StringVar(&o.webhookSecret, "webhook-secret", "", "sign webhook requests with HMAC-SHA256 of the body using this secret, sent as "+webhookSignatureHeader+": sha256=<hex>")
+	f.DurationVar(&o.webhookTimeout, "webhook-timeout", 10*time.Second, "timeout for a webhook request")
+	f.IntVar(&o.webhookBatch, "webhook-batch", 1, "post up to N events per request as a JSON array")
+	f.DurationVar(&o.webhookBatchWait, "webhook-batch-wait", time.Second, "with -webhook-batch, send a batch that is not full after this delay")
+	o.formatOptions.SetFlags(f)
+}
+
+// sink returns the URL given with -sink or -webhook.
+func (o *handlerOptions) sink() string {
+	if o.webhookURL != "" {
+		return o.webhookURL
+	}
+	return o.sinkURL
+}
+
+// concurrency returns how many events the dispatcher should handle at once for the -parallel value n.
+// A webhook batch can only fill up if that many events are handled at the same time.
+func (o *handlerOptions) concurrency(n int) int {
+	if u := o.sink(); (strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) && o.webhookBatch > n {
+		return o.webhookBatch
+	}
+	return n
+}
+
+// execHandler runs the command for every event and passes the event as JSON via stdin.
+// Placeholders in the arguments are replaced with fields of the event.
+type execHandler struct {
+	args    handlerArgs
+	env     eventEnv
+	timeout time.Duration // 0 for none
+	grace   time.Duration // between SIGTERM and SIGKILL
+}
+
+func (h execHandler) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	args, err := h.args.expand(b)
+	if err != nil {
+		return err
+	}
+	env, err := h.env.vars(b)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	if h.timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, h.timeout)
+	}
+	defer cancel()
+	// kills the command if it is still running when Send returns
+	killCtx, kill := context.WithCancel(context.Background())
+	defer kill()
+
+	stderr := &tailBuffer{max: stderrTailSize}
+	cmd := exec.CommandContext(killCtx, args[0], args[1:]...)
+	setProcessGroup(cmd)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewBuffer(b)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if err := cmd.Start(); err != nil {
+		return &handlerError{Err: err}
+	}
+
+	trackProcess(cmd.Process)
+	defer untrackProcess(cmd.Process)
+	started := time.Now()
+
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-runCtx.Done():
+		stopProcess(cmd.Process, exited, h.grace)
+		<-exited
+		handlerDuration.observe(time.Since(started).Seconds(), handlerModeExec)
+		if ctx.Err() != nil {
+			handlerExits.add(1, handlerModeExec, exitCode(waitErr))
+			return ctx.Err()
+		}
+		handlerExits.add(1, handlerModeExec, "timeout")
+		return &handlerError{Stderr: stderr.String(), Err: &handlerTimeoutError{Duration: h.timeout}}
+	}
+	handlerDuration.observe(time.Since(started).Seconds(), handlerModeExec)
+	handlerExits.add(1, handlerModeExec, exitCode(waitErr))
+
+	if waitErr != nil {
+		herr := &handlerError{Stderr: stderr.String(), Err: waitErr}
+		if exitErr, ok := waitErr.(*exec.ExitError); ok {
+			herr.ExitCode = processExitCode(exitErr)
+		}
+		return herr
+	}
+	return nil
+}
+
+func (h execHandler) Close() error { return nil }
+
+// processExitCode returns the exit code of a process, or -1 if it was killed by a signal.
+func processExitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	return -1
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+)
+
+// maxQueuedEvents limits how many events may wait behind a running event with the same key.
+const maxQueuedEvents = 1000
+
+// parallelOptions are the flags for running handlers in parallel.
+type parallelOptions struct {
+	parallel int
+}
+
+func (o *parallelOptions) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&o.parallel, "parallel", 1, "run the handler for up to N events at the same time. Events for the same resource still run in order")
+}
+
+// dispatchedEvent is an event together with the function to call once it has been handled.
+type dispatchedEvent struct {
+	event interface{}
+	done  func(error)
+}
+
+// dispatcher runs the handler for up to n events at once. Events with the same key run one
+// after another, in the order they were dispatched. With n <= 1, dispatch runs the handler directly.
+type dispatcher struct {
+	h   EventSink
+	key func(ctx context.Context, event interface{}) string
+
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	m      sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]dispatchedEvent // events waiting per key, a key is present while its events are running
+	queued int
+}
+
+func newDispatcher(h EventSink, n int, key func(context.Context, interface{}) string) *dispatcher {
+	p := &dispatcher{h: h, key: key, queues: map[string][]dispatchedEvent{}}
+	p.cond = sync.NewCond(&p.m)
+	if n > 1 {
+		p.slots = make(chan struct{}, n)
+	}
+	return p
+}
+
+// dispatch starts handling the event and calls done with the result of the handler. It only returns
+// an error if ctx is done before the event could be started, done is not called in that case.
+func (p *dispatcher) dispatch(ctx context.Context, event interface{}, done func(error)) error {
+	if p.slots == nil {
+		done(p.h.Send(ctx, event))
+		return nil
+	}
+
+	e := dispatchedEvent{event: event, done: done}
+	key := p.key(ctx, event)
+	p.m.Lock()
+	for {
+		if _, running := p.queues[key]; !running {
+			break
+		}
+		if p.queued < maxQueuedEvents {
+			p.queues[key] = append(p.queues[key], e)
+			p.queued++
+			p.m.Unlock()
+			return nil
+		}
+		p.cond.Wait()
+	}
+	p.queues[key] = nil
+	p.m.Unlock()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		p.m.Lock()
+		delete(p.queues, key)
+		p.cond.Broadcast()
+		p.m.Unlock()
+		return ctx.Err()
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+
+		for {
+			e.done(p.h.Send(ctx, e.event))
+
+			p.m.Lock()
+			if len(p.queues[key]) == 0 {
+				delete(p.queues, key)
+				p.cond.Broadcast()
+				p.m.Unlock()
+				return
+			}
+			e = p.queues[key][0]
+			p.queues[key] = p.queues[key][1:]
+			p.queued--
+			p.cond.Broadcast()
+			p.m.Unlock()
+		}
+	}()
+	return nil
+}
+
+// wait blocks until all dispatched events have been handled.
+func (p *dispatcher) wait() {
+	p.wg.Wait()
+}
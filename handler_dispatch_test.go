@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type keyedEvent struct {
+	key string
+	n   int
+}
+
+// recordingSink records the order in which events are handled and how many run at once.
+type recordingSink struct {
+	m          sync.Mutex
+	running    map[string]bool
+	maxRunning int
+	overlap    []string // keys whose events ran at the same time
+	handled    map[string][]int
+}
+
+func (s *recordingSink) Send(ctx context.Context, event interface{}) error {
+	e := event.(keyedEvent)
+	s.m.Lock()
+	if s.running[e.key] {
+		s.overlap = append(s.overlap, e.key)
+	}
+	s.running[e.key] = true
+	if len(s.running) > s.maxRunning {
+		s.maxRunning = len(s.running)
+	}
+	s.m.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	s.m.Lock()
+	delete(s.running, e.key)
+	s.handled[e.key] = append(s.handled[e.key], e.n)
+	s.m.Unlock()
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestDispatcherOrder(t *testing.T) {
+	for _, n := range []int{1, 4} {
+		sink := &recordingSink{running: map[string]bool{}, handled: map[string][]int{}}
+		d := newDispatcher(sink, n, func(_ context.Context, event interface{}) string { return event.(keyedEvent).key })
+
+		keys := []string{"a", "b", "c", "d"}
+		expected := map[string][]int{}
+		for i := 0; i < 20; i++ {
+			for _, key := range keys {
+				if err := d.dispatch(context.Background(), keyedEvent{key, i}, func(error) {}); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = append(expected[key], i)
+			}
+		}
+		d.wait()
+
+		if !reflect.DeepEqual(sink.handled, expected) {
+			t.Errorf("parallel %d: events of a key not handled in order: %v", n, sink.handled)
+		}
+		if len(sink.overlap) > 0 {
+			t.Errorf("parallel %d: events of keys %v ran at the same time", n, sink.overlap)
+		}
+		if n > 1 && sink.maxRunning < 2 {
+			t.Errorf("parallel %d: events of different keys did not run concurrently", n)
+		}
+		if sink.maxRunning > n {
+			t.Errorf("parallel %d: %d events ran at once", n, sink.maxRunning)
+		}
+	}
+}
+
+func TestDispatcherDone(t *testing.T) {
+	sink := &recordingSink{running: map[string]bool{}, handled: map[string][]int{}}
+	d := newDispatcher(sink, 3, func(_ context.Context, event interface{}) string { return event.(keyedEvent).key })
+	var m sync.Mutex
+	done := 0
+	for i := 0; i < 50; i++ {
+		d.dispatch(context.Background(), keyedEvent{fmt.Sprint(i % 2), i}, func(error) {
+			m.Lock()
+			done++
+			m.Unlock()
+		})
+	}
+	d.wait()
+	if done != 50 {
+		t.Errorf("done called %d times, expected 50", done)
+	}
+}
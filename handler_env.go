@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+// argFuncs are the functions available in placeholders of handler arguments.
+var argFuncs = template.FuncMap{"quote": shellQuote}
+
+// shellQuote quotes s for use in a POSIX shell command line, e.g. in the argument of sh -c.
+func shellQuote(s interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(s), "'", `'\''`, -1) + "'"
+}
+
+// handlerArgs are the arguments of a handler command. Arguments may contain placeholders like
+// {{.ID}} which are replaced with fields of the event.
+type handlerArgs struct {
+	args      []string
+	templates []*template.Template // nil for arguments without placeholders
+}
+
+func parseHandlerArgs(args []string) (handlerArgs, error) {
+	a := handlerArgs{args: args, templates: make([]*template.Template, len(args))}
+	for i, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			continue
+		}
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Funcs(argFuncs).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return a, fmt.Errorf("invalid placeholder in %q: %s", arg, err.Error())
+		}
+		a.templates[i] = t
+	}
+	return a, nil
+}
+
+func (a handlerArgs) hasPlaceholders() bool {
+	for _, t := range a.templates {
+		if t != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the arguments for the JSON event b. Each argument is passed to the command as is,
+// without a shell, so values need no quoting unless the command is a shell itself.
+func (a handlerArgs) expand(b []byte) ([]string, error) {
+	if !a.hasPlaceholders() {
+		return a.args, nil
+	}
+	data, err := decodeEvent(b)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, len(a.args))
+	for i, t := range a.templates {
+		if t == nil {
+			args[i] = a.args[i]
+			continue
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, data); err != nil {
+			return nil, err
+		}
+		args[i] = out.String()
+	}
+	return args, nil
+}
+
+// eventEnv sets the ORTHANC_* environment variables of handler commands.
+type eventEnv struct {
+	kind       string // "change", "patient", ... names the variables, ORTHANC_CHANGE_ID
+	orthancURL string
+}
+
+// handlerURL returns the URL of a for ORTHANC_URL, without the credentials that handlers could leak in logs.
+func handlerURL(a *api.Api) string {
+	u := *a.BaseURL
+	u.User = nil
+	return u.String()
+}
+
+// vars returns ORTHANC_URL and, if b is set, a variable for every field of the JSON event b.
+func (e eventEnv) vars(b []byte) ([]string, error) {
+	vars := []string{}
+	if e.orthancURL != "" {
+		vars = append(vars, "ORTHANC_URL="+e.orthancURL)
+	}
+	if b == nil {
+		return vars, nil
+	}
+	keys, values, err := flattenJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		vars = append(vars, e.name(k)+"="+values[k])
+	}
+	return vars, nil
+}
+
+// name returns the variable name for a flattened field: ID becomes ORTHANC_CHANGE_ID,
+// Series.MainDicomTags.Modality becomes ORTHANC_CHANGE_SERIES_MAIN_DICOM_TAGS_MODALITY.
+// A leading repetition of the kind is dropped, ChangeType becomes ORTHANC_CHANGE_TYPE.
+func (e eventEnv) name(key string) string {
+	kind := strings.ToUpper(e.kind)
+	if kind == "" {
+		kind = "EVENT"
+	}
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		parts[i] = envWord(p)
+	}
+	name := strings.Join(parts, "_")
+	if strings.HasPrefix(name, kind+"_") {
+		name = name[len(kind)+1:]
+	}
+	return "ORTHANC_" + kind + "_" + name
+}
+
+// envWord converts a field name like SOPInstanceUID to SOP_INSTANCE_UID. Characters that are not
+// allowed in variable names become underscores.
+func envWord(s string) string {
+	r := []rune(s)
+	var b bytes.Buffer
+	for i, c := range r {
+		if !(c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c))) {
+			b.WriteByte('_')
+			continue
+		}
+		if i > 0 && unicode.IsUpper(c) {
+			prevLower := unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1])
+			acronymEnd := unicode.IsUpper(r[i-1]) && i+1 < len(r) && unicode.IsLower(r[i+1])
+			if prevLower || acronymEnd {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
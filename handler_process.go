@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// runningProcesses are the handler processes that are killed when orthanctool is forced to exit.
+// They run in their own process groups and do not receive the signal from the terminal.
+var runningProcesses = struct {
+	sync.Mutex
+	m map[*os.Process]bool
+}{m: map[*os.Process]bool{}}
+
+func trackProcess(p *os.Process) {
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+	runningProcesses.m[p] = true
+}
+
+func untrackProcess(p *os.Process) {
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+	delete(runningProcesses.m, p)
+}
+
+func killRunningProcesses() {
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+	for p := range runningProcesses.m {
+		killProcessGroup(p)
+	}
+}
+
+// handlerTimeoutError is returned when a handler did not finish within -handler-timeout.
+type handlerTimeoutError struct {
+	Duration time.Duration
+}
+
+func (e *handlerTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.Duration)
+}
+
+// Timeout reports that the error is a timeout, like net.Error.
+func (e *handlerTimeoutError) Timeout() bool { return true }
+
+// stopProcess asks the process group of p to terminate and kills it if it has not exited after
+// grace. exited must be closed once the process has been waited for.
+func stopProcess(p *os.Process, exited <-chan struct{}, grace time.Duration) {
+	if err := terminateProcessGroup(p); err != nil {
+		killProcessGroup(p)
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(grace):
+		fmt.Fprintf(os.Stderr, "handler (pid %d) did not exit within %s, killing it\n", p.Pid, grace)
+		killProcessGroup(p)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is a single entry in the dead-letter file.
+type deadLetter struct {
+	Kind     string `json:",omitempty"` // the kind of event, e.g. change or patient
+	Event    json.RawMessage
+	Error    string
+	ExitCode int    `json:",omitempty"`
+	Stderr   string `json:",omitempty"`
+	Attempts int
+	Time     string
+}
+
+// retryHandler retries failed events, backing off between attempts. Events that still fail are
+// appended to deadLetter if it is set. Those events count as handled, Send returns nil for them.
+type retryHandler struct {
+	h          EventSink
+	retries    int
+	backoff    time.Duration
+	deadLetter io.WriteCloser
+	kind       string
+
+	m sync.Mutex // serializes writes to deadLetter
+}
+
+func (r *retryHandler) Send(ctx context.Context, event interface{}) error {
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		err := r.h.Send(ctx, event)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= r.retries {
+			if r.deadLetter == nil {
+				return err
+			}
+			return r.bury(event, err, attempt+1)
+		}
+		fmt.Fprintf(os.Stderr, "retry event: %s\n", err.Error())
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// bury appends an event that failed to the dead-letter file.
+func (r *retryHandler) bury(event interface{}, err error, attempts int) error {
+	b, jsonErr := json.Marshal(event)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	entry := deadLetter{Kind: r.kind, Event: b, Error: err.Error(), Attempts: attempts, Time: time.Now().Format(time.RFC3339)}
+	if herr, ok := err.(*handlerError); ok {
+		entry.ExitCode = herr.ExitCode
+		entry.Stderr = herr.Stderr
+	}
+	line, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	fmt.Fprintf(os.Stderr, "dead letter: %s\n", err.Error())
+	_, writeErr := fmt.Fprintf(r.deadLetter, "%s\n", line)
+	return writeErr
+}
+
+func (r *retryHandler) Close() error {
+	err := r.h.Close()
+	if r.deadLetter != nil {
+		if closeErr := r.deadLetter.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
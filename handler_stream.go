@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxHandlerRestartBackoff = 30 * time.Second
+	// a handler that ran at least this long before exiting is restarted without delay
+	handlerStableAfter = time.Minute
+)
+
+var errHandlerClosed = fmt.Errorf("handler closed")
+
+// streamEvent is an event written to a stream handler, waiting for its acknowledgement.
+type streamEvent struct {
+	data     []byte
+	done     chan error
+	timedOut bool // not acknowledged within the timeout, dropped when the command is restarted
+}
+
+// streamHandler starts the command once and writes every event as a JSON line to its stdin.
+// If the command exits, it is restarted with increasing delays.
+//
+// With acks, the command must write one line to stdout for every event it has processed, in the
+// order the events were received. A line that is a JSON object with a non-empty "error" field
+// marks the event as failed. Events that were not acknowledged when the command exited are written
+// again to the restarted command. If an event is not acknowledged within timeout, it fails and the
+// command is restarted.
+type streamHandler struct {
+	cmd     []string
+	acks    bool
+	env     []string // added to the environment of the command
+	timeout time.Duration
+	grace   time.Duration
+
+	w     sync.Mutex // guards stdin, proc, closed and err
+	cond  *sync.Cond // signaled when stdin, closed or err change
+	stdin io.WriteCloser
+	// writing is held by the Send that writes to stdin, so events are written whole and in the order
+	// they were added to pending. h.w is not held while writing: a command that stops reading its
+	// stdin can still be timed out, stopped and closed.
+	writing chan struct{}
+	// the running command, procExited is closed once it exited
+	proc       *os.Process
+	procExited chan struct{}
+	stopping   bool
+	// closed is set by Close, err when the command could not be started
+	closed bool
+	err    error
+
+	m       sync.Mutex     // guards pending and headSince
+	pending []*streamEvent // written but not acknowledged yet, oldest first
+	// when the oldest pending event started waiting for the running command
+	headSince time.Time
+
+	closing chan struct{}
+	exited  chan struct{}
+	exitErr error
+}
+
+func newStreamHandler(cmd []string, acks bool, env []string, timeout, grace time.Duration) *streamHandler {
+	h := &streamHandler{cmd: cmd, acks: acks, env: env, timeout: timeout, grace: grace, writing: make(chan struct{}, 1), closing: make(chan struct{}), exited: make(chan struct{})}
+	h.cond = sync.NewCond(&h.w)
+	go h.supervise()
+	return h
+}
+
+func (h *streamHandler) start() (*exec.Cmd, io.WriteCloser, io.ReadCloser, error) {
+	cmd := exec.Command(h.cmd[0], h.cmd[1:]...)
+	setProcessGroup(cmd)
+	cmd.Env = append(os.Environ(), h.env...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var stdout io.ReadCloser
+	if h.acks {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		cmd.Stdout = os.Stdout
+	}
+	return cmd, stdin, stdout, cmd.Start()
+}
+
+// supervise runs the command until Close is called, restarting it whenever it exits.
+func (h *streamHandler) supervise() {
+	defer close(h.exited)
+
+	backoff := time.Second
+	for {
+		cmd, stdin, stdout, err := h.start()
+		if err != nil {
+			h.w.Lock()
+			h.err = err
+			h.cond.Broadcast()
+			h.w.Unlock()
+			h.failPending(err)
+			return
+		}
+		started := time.Now()
+		trackProcess(cmd.Process)
+
+		exited := make(chan struct{})
+		h.w.Lock()
+		h.proc, h.procExited, h.stopping = cmd.Process, exited, false
+		h.m.Lock()
+		replay := []*streamEvent{}
+		pending := h.pending[:0]
+		for _, e := range h.pending {
+			if !e.timedOut {
+				replay = append(replay, e)
+				pending = append(pending, e)
+			}
+		}
+		h.pending = pending
+		h.headSince = time.Now()
+		h.m.Unlock()
+		h.w.Unlock()
+
+		acksRead := make(chan struct{})
+		go func() {
+			defer close(acksRead)
+			if stdout != nil {
+				h.readAcks(stdout)
+			}
+		}()
+		// stdin is not visible to Send yet, so the replayed events are written before new ones
+		for _, e := range replay {
+			if _, err := stdin.Write(e.data); err != nil {
+				break // exited again, the events stay pending
+			}
+		}
+		h.w.Lock()
+		if h.closed {
+			stdin.Close()
+		} else {
+			h.stdin = stdin
+		}
+		h.cond.Broadcast()
+		h.w.Unlock()
+
+		<-acksRead
+		err = cmd.Wait()
+		close(exited)
+		untrackProcess(cmd.Process)
+		handlerExits.add(1, handlerModeStream, exitCode(err))
+
+		h.w.Lock()
+		h.stdin = nil
+		h.proc = nil
+		closed := h.closed
+		h.w.Unlock()
+		if closed {
+			h.exitErr = err
+			h.failPending(fmt.Errorf("handler exited before acknowledging the event"))
+			return
+		}
+
+		if time.Since(started) >= handlerStableAfter {
+			backoff = time.Second
+		}
+		fmt.Fprintf(os.Stderr, "handler %s exited (%v), restarting in %s\n", h.cmd[0], err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-h.closing:
+			h.failPending(errHandlerClosed)
+			return
+		}
+		if backoff *= 2; backoff > maxHandlerRestartBackoff {
+			backoff = maxHandlerRestartBackoff
+		}
+	}
+}
+
+// readAcks resolves pending events, one for every line the command writes to stdout.
+func (h *streamHandler) readAcks(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		h.m.Lock()
+		if len(h.pending) == 0 {
+			h.m.Unlock()
+			fmt.Fprintf(os.Stderr, "handler %s: unexpected acknowledgement %q\n", h.cmd[0], scanner.Text())
+			continue
+		}
+		e := h.pending[0]
+		h.pending = h.pending[1:]
+		h.headSince = time.Now()
+		h.m.Unlock()
+
+		e.done <- ackError(scanner.Text())
+	}
+}
+
+// ackError returns the error reported by an acknowledgement line, if any.
+func ackError(line string) error {
+	var ack struct {
+		Error string `json:"error"`
+	}
+	if strings.HasPrefix(strings.TrimSpace(line), "{") && json.Unmarshal([]byte(line), &ack) == nil && ack.Error != "" {
+		return &handlerError{Err: fmt.Errorf("%s", ack.Error)}
+	}
+	return nil
+}
+
+func (h *streamHandler) failPending(err error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, e := range h.pending {
+		e.done <- err
+	}
+	h.pending = nil
+}
+
+func (h *streamHandler) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	e := &streamEvent{data: append(b, '\n'), done: make(chan error, 1)}
+
+	select {
+	case h.writing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err = h.write(e)
+	<-h.writing
+	if err != nil || !h.acks {
+		return err
+	}
+	sent := time.Now()
+	var timeout <-chan time.Time
+	if h.timeout > 0 {
+		t := time.NewTimer(h.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		select {
+		case err := <-e.done:
+			handlerDuration.observe(time.Since(sent).Seconds(), handlerModeStream)
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			if wait := h.timeOut(e); wait > 0 {
+				// waiting behind an older event or for a restart is not the fault of this event
+				timeout = time.After(wait)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "handler %s did not acknowledge an event within %s, restarting it\n", h.cmd[0], h.timeout)
+			go h.stop()
+			return &handlerError{Err: &handlerTimeoutError{Duration: h.timeout}}
+		}
+	}
+}
+
+// write writes e to the running command, waiting for it to be started. h.writing must be held.
+func (h *streamHandler) write(e *streamEvent) error {
+	for {
+		h.w.Lock()
+		for h.stdin == nil && !h.closed && h.err == nil {
+			h.cond.Wait()
+		}
+		if h.err != nil || h.closed {
+			err := h.err
+			if err == nil {
+				err = errHandlerClosed
+			}
+			h.w.Unlock()
+			return err
+		}
+		stdin := h.stdin
+		if h.acks {
+			h.m.Lock()
+			if len(h.pending) == 0 {
+				h.headSince = time.Now()
+			}
+			h.pending = append(h.pending, e)
+			h.m.Unlock()
+		}
+		h.w.Unlock()
+
+		// a command that does not read an event within the timeout is restarted
+		var timer *time.Timer
+		if h.timeout > 0 {
+			timer = time.AfterFunc(h.timeout, func() {
+				fmt.Fprintf(os.Stderr, "handler %s did not read an event within %s, restarting it\n", h.cmd[0], h.timeout)
+				h.stop()
+			})
+		}
+		_, err := stdin.Write(e.data)
+		timedOut := timer != nil && !timer.Stop()
+		if h.acks {
+			// an event that could not be written is replayed after the restart, the timeout of its
+			// acknowledgement applies
+			return nil
+		}
+		if timedOut {
+			return &handlerError{Err: &handlerTimeoutError{Duration: h.timeout}}
+		}
+		if err == nil {
+			return nil
+		}
+		h.w.Lock()
+		if h.stdin == stdin {
+			h.stdin = nil // wait for the restart and write the event again
+		}
+		h.w.Unlock()
+	}
+}
+
+// timeOut marks e as timed out if it is the oldest pending event and the running command has not
+// acknowledged it for the whole timeout. Otherwise it returns how long to wait before checking again.
+func (h *streamHandler) timeOut(e *streamEvent) time.Duration {
+	h.w.Lock()
+	defer h.w.Unlock()
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.proc == nil || h.stopping || len(h.pending) == 0 || h.pending[0] != e {
+		return h.timeout
+	}
+	if waited := time.Since(h.headSince); waited < h.timeout {
+		return h.timeout - waited
+	}
+	e.timedOut = true
+	return 0
+}
+
+// stop terminates the running command, it is restarted by supervise unless the handler is closed.
+func (h *streamHandler) stop() {
+	h.w.Lock()
+	p, exited := h.proc, h.procExited
+	if p == nil || h.stopping {
+		h.w.Unlock()
+		return
+	}
+	h.stopping = true
+	h.w.Unlock()
+	stopProcess(p, exited, h.grace)
+}
+
+// Close closes the command's stdin and waits for it to exit. A command that does not exit within
+// grace is stopped.
+func (h *streamHandler) Close() error {
+	h.w.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.closing)
+		if h.stdin != nil {
+			h.stdin.Close()
+		}
+		h.cond.Broadcast()
+	}
+	h.w.Unlock()
+
+	select {
+	case <-h.exited:
+	case <-time.After(h.grace):
+		h.stop()
+		<-h.exited
+	}
+	if h.err != nil {
+		return h.err
+	}
+	return h.exitErr
+}
@@ -0,0 +1,78 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bigEvent does not fit into a pipe buffer, writing it blocks until the command reads it.
+var bigEvent = map[string]string{"Data": strings.Repeat("x", 256*1024)}
+
+func TestStreamHandlerNotReadingStdin(t *testing.T) {
+	for _, acks := range []bool{true, false} {
+		h := newStreamHandler([]string{"sleep", "60"}, acks, nil, 300*time.Millisecond, 200*time.Millisecond)
+
+		errors := make(chan error, 2)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errors <- h.Send(context.Background(), bigEvent)
+			}()
+		}
+		sent := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(sent)
+		}()
+		select {
+		case <-sent:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("acks %v: Send blocked by a handler that does not read its stdin", acks)
+		}
+		if err := <-errors; err == nil {
+			t.Errorf("acks %v: expected the first event to time out", acks)
+		} else if herr, ok := err.(*handlerError); !ok || !isTimeout(herr.Err) {
+			t.Errorf("acks %v: expected a timeout, got %v", acks, err)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			h.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("acks %v: Close blocked by a handler that does not read its stdin", acks)
+		}
+	}
+}
+
+func TestStreamHandlerAcks(t *testing.T) {
+	h := newStreamHandler([]string{"sh", "-c", `while read line; do echo ok; done`}, true, nil, 5*time.Second, time.Second)
+	errors := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() { errors <- h.Send(context.Background(), bigEvent) }()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errors; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*handlerTimeoutError)
+	return ok
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const dicomPreambleLength = 128
+
+// importFile is a file to import, either on disk or inside an archive.
+type importFile struct {
+	Name string // path on disk, entries of archives are named <archive>!<entry>
+	size int64  // -1 if unknown
+	open func() (io.ReadCloser, error)
+	done func() // called once the file has been processed, may be nil
+}
+
+func (f importFile) finish() {
+	if f.done != nil {
+		f.done()
+	}
+}
+
+// isDicom reports whether the file starts with the DICOM preamble followed by "DICM".
+func (f importFile) isDicom() (bool, error) {
+	r, err := f.open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	header := make([]byte, dicomPreambleLength+4)
+	if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(header[dicomPreambleLength:], []byte("DICM")), nil
+}
+
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// importFiles walks the given paths recursively and sends every file found to files, including
+// the entries of ZIP and tar(.gz) archives. Files that can not be read are passed to onError.
+// DICOMDIR files are skipped, they only index the other files. Files are named by their absolute
+// path, so the log of an import can be resumed from any directory.
+func importFiles(ctx context.Context, paths []string, files chan<- importFile, onError func(name string, err error)) error {
+	send := func(f importFile) error {
+		select {
+		case files <- f:
+			return nil
+		case <-ctx.Done():
+			f.finish()
+			return ctx.Err()
+		}
+	}
+
+	for _, root := range paths {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				onError(path, err)
+				return nil
+			}
+			if info.IsDir() || !info.Mode().IsRegular() || strings.EqualFold(info.Name(), "DICOMDIR") {
+				return nil
+			}
+
+			switch archiveKind(path) {
+			case "zip":
+				err = zipFiles(path, send)
+			case "tar.gz", "tar":
+				err = tarFiles(path, archiveKind(path) == "tar.gz", send)
+			default:
+				err = send(importFile{Name: path, size: info.Size(), open: func() (io.ReadCloser, error) { return os.Open(path) }})
+			}
+			if err != nil && ctx.Err() == nil {
+				onError(path, err)
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zipFiles sends every entry of a ZIP file. Entries are read directly from the archive,
+// which is closed once all of them have been processed.
+func zipFiles(path string, send func(importFile) error) error {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	wg := sync.WaitGroup{}
+	defer func() {
+		go func() {
+			wg.Wait()
+			z.Close()
+		}()
+	}()
+
+	for _, zf := range z.File {
+		if zf.FileInfo().IsDir() || strings.EqualFold(filepath.Base(zf.Name), "DICOMDIR") {
+			continue
+		}
+		wg.Add(1)
+		if err := send(importFile{Name: path + "!" + zf.Name, size: int64(zf.UncompressedSize64), open: zf.Open, done: wg.Done}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarFiles sends every entry of a tar file. A tar file can only be read sequentially, so each
+// entry is spooled before it is sent.
+func tarFiles(path string, gzipped bool, send func(importFile) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() || strings.EqualFold(filepath.Base(hdr.Name), "DICOMDIR") {
+			continue
+		}
+
+		s, err := spool(tr, hdr.Size)
+		if err != nil {
+			return err
+		}
+		err = send(importFile{
+			Name: path + "!" + hdr.Name,
+			size: s.size,
+			open: func() (io.ReadCloser, error) { return ioutil.NopCloser(s.reader()), nil },
+			done: func() { s.Close() },
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -1,29 +1,40 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"strings"
 
 	"github.com/google/subcommands"
 	"github.com/levinalex/orthanctool/api"
 )
 
 func main() {
-	subcommands.Register(CloneCommand(), "")
-	subcommands.Register(ChangesCommand(), "")
-	subcommands.Register(RecentPatientsCommand(), "")
+	subcommands.Register(configuredCommand{CloneCommand()}, "")
+	subcommands.Register(configuredCommand{ChangesCommand()}, "")
+	subcommands.Register(configuredCommand{DaemonCommand()}, "")
+	subcommands.Register(configuredCommand{ExportCommand()}, "")
+	subcommands.Register(configuredCommand{ImportCommand()}, "")
+	subcommands.Register(configuredCommand{RecentPatientsCommand()}, "")
+	subcommands.Register(configuredCommand{ReplayCommand()}, "")
+	subcommands.Register(configuredCommand{RetentionCommand()}, "")
 	subcommands.Register(subcommands.HelpCommand(), "help")
 	subcommands.Register(subcommands.FlagsCommand(), "help")
 	subcommands.Register(subcommands.CommandsCommand(), "help")
 
+	configPath := flag.String("config", "", "config file, defaults to $ORTHANCTOOL_CONFIG or ~/.config/orthanctool/config.yaml")
 	flag.Parse()
-	ctx := context.Background()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		os.Exit(int(fail(err)))
+	}
+	activeConfig = c
+
+	ctx := withShutdown(context.Background())
 	os.Exit(int(subcommands.Execute(ctx)))
 }
 
@@ -31,13 +42,27 @@ type apiFlag struct {
 	*api.Api
 }
 
+// Set accepts a URL or @name of a server in the config file.
 func (a *apiFlag) Set(s string) error {
-	ap, err := api.New(s)
-	if err == nil {
-		a.Api = ap
+	var ap *api.Api
+	var err error
+	if strings.HasPrefix(s, "@") {
+		var server serverConfig
+		server, err = activeConfig.server(s[1:])
+		if err == nil {
+			ap, err = server.api()
+		}
+	} else {
+		ap, err = api.New(s)
+	}
+	if err != nil {
+		return err
 	}
 	ap.Logger = log.New(os.Stderr, "", 0)
-	return err
+	ap.ChangeFeed = changeFeeds.feed(ap)
+	ap.Metrics = apiMetrics{server: destName(ap)}
+	a.Api = ap
+	return nil
 }
 func (a apiFlag) String() string {
 	if a.Api != nil {
@@ -47,6 +72,15 @@ func (a apiFlag) String() string {
 	}
 }
 
+// stringListFlag collects the values of a repeatable flag.
+type stringListFlag []string
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+func (s stringListFlag) String() string { return strings.Join(s, ",") }
+
 func fail(e error) subcommands.ExitStatus {
 	fmt.Fprintf(os.Stderr, "%s\n", e.Error())
 	return subcommands.ExitFailure
@@ -66,23 +100,3 @@ func readFirstError(errors <-chan error, onError func()) <-chan error {
 	}()
 	return returnError
 }
-
-func cmdAction(cmd []string, data interface{}) error {
-	b, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-	if len(cmd) == 0 {
-		fmt.Println(string(b))
-	} else {
-		cmd := exec.Command(cmd[0], cmd[1:]...)
-		cmd.Stdin = bytes.NewBuffer(b)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricFamily is a metric with all its label combinations, written in the Prometheus text format.
+type metricFamily interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+var registeredMetrics []metricFamily
+
+func register(m metricFamily) { registeredMetrics = append(registeredMetrics, m) }
+
+// durationBuckets are the histogram buckets for durations in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	httpRequests = newCounter("orthanctool_http_requests_total", "Requests to Orthanc servers.",
+		"server", "method", "endpoint", "status")
+	httpRequestDuration = newHistogram("orthanctool_http_request_duration_seconds", "Time until the response headers of a request to an Orthanc server arrived.",
+		durationBuckets, "server", "method", "endpoint")
+	bytesDownloaded = newCounter("orthanctool_downloaded_bytes_total", "Bytes received from Orthanc servers.", "server")
+	bytesUploaded   = newCounter("orthanctool_uploaded_bytes_total", "Bytes sent to Orthanc servers.", "server")
+
+	instancesCopied = newCounter("orthanctool_instances_copied_total", "Instances copied by clone, by the status reported by the destination.",
+		"destination", "status")
+	instancesFailed = newCounter("orthanctool_instances_failed_total", "Instances that clone failed to copy after all retries.", "destination")
+
+	changeLag = newLagGauge("orthanctool_change_watch_lag", "Sequence number of the last change of the server minus that of the last change processed.")
+
+	handlerDuration = newHistogram("orthanctool_handler_duration_seconds", "Time a handler took for an event.",
+		durationBuckets, "mode")
+	handlerExits = newCounter("orthanctool_handler_exits_total", "Handler commands that exited, by exit code.", "mode", "code")
+
+	patientQueueLength = newGauge("orthanctool_patient_queue_length", "Patients waiting in the queue of recent-patients.")
+)
+
+// metricVec is a counter or gauge.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+
+	m      sync.Mutex
+	values map[string]float64 // by joined label values
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, help: help, kind: "counter", labels: labels, values: map[string]float64{}}
+	if len(labels) == 0 {
+		v.values[""] = 0
+	}
+	register(v)
+	return v
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	v := newCounter(name, help, labels...)
+	v.kind = "gauge"
+	return v
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string { return strings.Join(values, "\x00") }
+
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.values[labelKey(labelValues)] += delta
+}
+
+func (v *metricVec) set(value float64, labelValues ...string) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.values[labelKey(labelValues)] = value
+}
+
+func (v *metricVec) metricName() string { return v.name }
+
+func (v *metricVec) write(w io.Writer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	writeHeader(w, v.name, v.help, v.kind)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, key, ""), formatValue(v.values[key]))
+	}
+}
+
+// histogramVec counts observations in buckets.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	m      sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	key := labelKey(labelValues)
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) metricName() string { return h.name }
+
+func (h *histogramVec) write(w io.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		cumulative := uint64(0)
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// lagGauge is the difference between the last change of a server and the last change a command
+// has processed, by command and server.
+type lagGauge struct {
+	name, help string
+
+	m         sync.Mutex
+	last      map[string]int    // by server
+	processed map[string]int    // by command and server
+	servers   map[string]string // server of each processed key
+}
+
+func newLagGauge(name, help string) *lagGauge {
+	g := &lagGauge{name: name, help: help, last: map[string]int{}, processed: map[string]int{}, servers: map[string]string{}}
+	register(g)
+	return g
+}
+
+// setLast records the newest change of server.
+func (g *lagGauge) setLast(server string, seq int) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if seq > g.last[server] {
+		g.last[server] = seq
+	}
+}
+
+// setProcessed records that command has processed the change seq of server.
+func (g *lagGauge) setProcessed(command, server string, seq int) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	key := labelKey([]string{command, server})
+	if seq > g.processed[key] {
+		g.processed[key] = seq
+		g.servers[key] = server
+	}
+}
+
+func (g *lagGauge) metricName() string { return g.name }
+
+func (g *lagGauge) write(w io.Writer) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	keys := make([]string, 0, len(g.processed))
+	for key := range g.processed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lag := g.last[g.servers[key]] - g.processed[key]
+		if lag < 0 {
+			lag = 0
+		}
+		fmt.Fprintf(w, "%s%s %d\n", g.name, formatLabels([]string{"command", "server"}, key, ""), lag)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns {name="value",...} for the joined label values in key, with an le label if
+// it is not empty.
+func formatLabels(names []string, key string, le string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, names[i]+`="`+labelValueEscaper.Replace(value)+`"`)
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metricsByName []metricFamily
+
+func (m metricsByName) Len() int           { return len(m) }
+func (m metricsByName) Less(i, j int) bool { return m[i].metricName() < m[j].metricName() }
+func (m metricsByName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	metrics := append([]metricFamily(nil), registeredMetrics...)
+	sort.Sort(metricsByName(metrics))
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// apiMetrics records the requests of the Api of one server.
+type apiMetrics struct {
+	server string
+}
+
+func (m apiMetrics) Request(method, endpoint string, status int, duration time.Duration) {
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	httpRequests.add(1, m.server, method, endpoint, code)
+	statuses.request(m.server, status)
+	httpRequestDuration.observe(duration.Seconds(), m.server, method, endpoint)
+}
+
+func (m apiMetrics) Transferred(downloaded, uploaded int64) {
+	if downloaded > 0 {
+		bytesDownloaded.add(float64(downloaded), m.server)
+	}
+	if uploaded > 0 {
+		bytesUploaded.add(float64(uploaded), m.server)
+	}
+}
+
+func (m apiMetrics) LastChange(seq int) { changeLag.setLast(m.server, seq) }
+
+// exitCode returns the exit code label of a handler command that finished with err.
+func exitCode(err error) string {
+	if err == nil {
+		return "0"
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if code := processExitCode(exitErr); code >= 0 {
+			return strconv.Itoa(code)
+		}
+		return "signal"
+	}
+	return "error"
+}
+
+// metricsOptions are the -metrics-addr and -health-* flags of long running commands.
+type metricsOptions struct {
+	metricsAddr string
+	health      healthOptions
+}
+
+func (o *metricsOptions) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&o.metricsAddr, "metrics-addr", "", "serve Prometheus metrics at http://<addr>/metrics and health checks at /healthz, /readyz and /status, e.g. :9100")
+	f.IntVar(&o.health.maxFailures, "health-max-failures", 3, "/healthz fails once this many polls in a row of a change watch got no response from the server")
+	f.DurationVar(&o.health.stallTimeout, "health-stall-timeout", 10*time.Minute, "/healthz fails if a change watch neither polled nor handled a change for this long, at least 3 poll intervals")
+}
+
+// startMetrics serves the metrics and health checks if -metrics-addr is set. stop shuts the server down.
+func (o *metricsOptions) startMetrics() (stop func(), err error) {
+	if o.metricsAddr == "" {
+		return func() {}, nil
+	}
+	l, err := net.Listen("tcp", o.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw)
+		bw.Flush()
+	})
+	o.health.handleStatus(mux)
+	server := &http.Server{Handler: mux}
+	stopped := make(chan struct{})
+	go func() {
+		err := server.Serve(l)
+		select {
+		case <-stopped: // Serve fails once stop closed the listener
+		default:
+			fmt.Fprintf(os.Stderr, "metrics: %s\n", err.Error())
+		}
+	}()
+	return func() {
+		close(stopped)
+		l.Close()
+	}, nil
+}
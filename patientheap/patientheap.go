@@ -40,10 +40,18 @@ func (p patientHeap) firstWithLength() (result PatientOutput) {
 // SortPatients takes a channel of Patients with an update timestamp and appeends them to a channel most recently changed patients first.
 //
 func SortPatients(done <-chan struct{}, patients <-chan Patient, doFilter bool) <-chan PatientOutput {
+	return SortPatientsFunc(done, patients, doFilter, nil)
+}
+
+// SortPatientsFunc is SortPatients, calling onLength with the number of waiting patients whenever it changes.
+func SortPatientsFunc(done <-chan struct{}, patients <-chan Patient, doFilter bool, onLength func(int)) <-chan PatientOutput {
 	var sorted = make(chan PatientOutput, 0)
 	var h = make(patientHeap, 0)
 	var output chan<- PatientOutput = nil // output channel is nil while heap is empty
 	var filterFunc = func(p Patient) bool { return true }
+	if onLength == nil {
+		onLength = func(int) {}
+	}
 
 	if doFilter {
 		var filter = map[string]string{}
@@ -62,6 +70,7 @@ func SortPatients(done <-chan struct{}, patients <-chan Patient, doFilter bool)
 			select {
 			case output <- h.firstWithLength():
 				heap.Remove(&h, 0)
+				onLength(h.Len())
 				if h.Len() == 0 {
 					output = nil
 				}
@@ -71,6 +80,7 @@ func SortPatients(done <-chan struct{}, patients <-chan Patient, doFilter bool)
 				} else {
 					if filterFunc(patient) {
 						heap.Push(&h, patient)
+						onLength(h.Len())
 						output = sorted
 					}
 				}
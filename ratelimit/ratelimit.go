@@ -0,0 +1,203 @@
+// Package ratelimit implements token bucket rate limits whose rate can depend on the time of day.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChunk limits how many bytes a limited reader returns at once, so the limit is enforced smoothly.
+const maxChunk = 32 * 1024
+
+// Rule sets the rate for a daily time window. A window where From equals To covers the whole day.
+// A Rate of 0 means unlimited.
+type Rule struct {
+	From time.Duration // since midnight
+	To   time.Duration // since midnight, may be before From to wrap around midnight
+	Rate float64       // per second
+}
+
+func (r Rule) matches(t time.Time) bool {
+	if r.From == r.To {
+		return true
+	}
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if r.From < r.To {
+		return sinceMidnight >= r.From && sinceMidnight < r.To
+	}
+	return sinceMidnight >= r.From || sinceMidnight < r.To
+}
+
+// Schedule is a list of rules. The first rule matching the current time of day applies,
+// when no rule matches the rate is unlimited.
+type Schedule []Rule
+
+func (s Schedule) RateAt(t time.Time) float64 {
+	for _, r := range s {
+		if r.matches(t) {
+			return r.Rate
+		}
+	}
+	return 0
+}
+
+// ParseRule parses a rule like "20" or "07:00-19:00=20" (requests per second).
+func ParseRule(s string) (Rule, error) {
+	return parseRule(s, func(rate string) (float64, error) {
+		return strconv.ParseFloat(rate, 64)
+	})
+}
+
+// ParseByteRule parses a rule like "10M" or "07:00-19:00=10MB/s" (bytes per second).
+// Rates accept the suffixes K, M and G (powers of 1024), "unlimited" or 0 disables the limit.
+func ParseByteRule(s string) (Rule, error) {
+	return parseRule(s, ParseBytes)
+}
+
+func parseRule(s string, parseRate func(string) (float64, error)) (rule Rule, err error) {
+	rate := s
+	if i := strings.Index(s, "="); i >= 0 {
+		window := strings.SplitN(s[:i], "-", 2)
+		if len(window) != 2 {
+			return rule, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", s[:i])
+		}
+		if rule.From, err = parseTimeOfDay(window[0]); err != nil {
+			return rule, err
+		}
+		if rule.To, err = parseTimeOfDay(window[1]); err != nil {
+			return rule, err
+		}
+		rate = s[i+1:]
+	}
+	if rate == "unlimited" {
+		return rule, nil
+	}
+	rule.Rate, err = parseRate(rate)
+	if err == nil && rule.Rate < 0 {
+		err = fmt.Errorf("invalid rate %q", rate)
+	}
+	return rule, err
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseBytes parses a byte count like "512K", "10M" or "1.5GB/s".
+func ParseBytes(s string) (float64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(s), "/S")
+	v = strings.TrimSuffix(v, "B")
+	v = strings.TrimSuffix(v, "I")
+
+	multiplier := 1.0
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			v = v[:n-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte rate %q", s)
+	}
+	return f * multiplier, nil
+}
+
+// Limiter is a token bucket that holds at most one second worth of tokens.
+// A nil Limiter does not limit anything.
+type Limiter struct {
+	m        sync.Mutex
+	schedule Schedule
+	tokens   float64
+	last     time.Time
+}
+
+func New(schedule Schedule) *Limiter {
+	return &Limiter{schedule: schedule}
+}
+
+// WaitN blocks until n tokens are available or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	now := time.Now()
+	rate := l.schedule.RateAt(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		l.m.Unlock()
+		return nil
+	}
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.m.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns a reader that takes one token for every byte read from r.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if waitErr := r.l.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/subcommands"
+)
+
+// shutdown is stored in the context passed to commands.
+type shutdown struct {
+	stopped chan struct{} // closed on the first signal
+	signal  os.Signal     // the first signal, set before stopped is closed
+}
+
+type shutdownKey struct{}
+
+// workKey holds the context that workContext derives from, it is cancelled on the second signal
+// and by the cancel functions returned by withCancel.
+type workKey struct{}
+
+// withShutdown returns a context that is cancelled on the first SIGINT or SIGTERM. Commands then stop
+// taking new work, but finish what they already started using workContext. The second signal also
+// cancels the work context, kills running handlers and exits.
+func withShutdown(parent context.Context) context.Context {
+	work, kill := context.WithCancel(parent)
+	s := &shutdown{stopped: make(chan struct{})}
+	ctx, stop := context.WithCancel(context.WithValue(context.WithValue(parent, shutdownKey{}, s), workKey{}, work))
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s.signal = <-signals
+		fmt.Fprintf(os.Stderr, "%s: finishing work in progress, repeat to exit immediately\n", s.signal)
+		close(s.stopped)
+		stop()
+
+		<-signals
+		fmt.Fprintf(os.Stderr, "exiting\n")
+		kill()
+		killRunningProcesses()
+		os.Exit(exitStatus(s.signal))
+	}()
+	return ctx
+}
+
+// workContext returns the context for work that has already started, which continues after the
+// first signal. It has the values of ctx and is cancelled on the second signal or when a context
+// between withShutdown and ctx is cancelled with withCancel. Outside of withShutdown it returns ctx.
+func workContext(ctx context.Context) context.Context {
+	work, ok := ctx.Value(workKey{}).(context.Context)
+	if !ok {
+		return ctx
+	}
+	return valuesContext{Context: work, values: ctx}
+}
+
+// withCancel is context.WithCancel for commands. Calling cancel also cancels the work contexts
+// derived from the returned context, e.g. to abort copies that are in progress after an error.
+func withCancel(parent context.Context) (context.Context, context.CancelFunc) {
+	work, cancelWork := context.WithCancel(workContext(parent))
+	ctx, cancelCtx := context.WithCancel(context.WithValue(parent, workKey{}, work))
+	return ctx, func() {
+		cancelCtx()
+		cancelWork()
+	}
+}
+
+// valuesContext is cancelled with Context but looks up values in values.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} { return c.values.Value(key) }
+
+// interrupted returns the signal that stopped the command, or nil.
+func interrupted(ctx context.Context) os.Signal {
+	s, ok := ctx.Value(shutdownKey{}).(*shutdown)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-s.stopped:
+		return s.signal
+	default:
+		return nil
+	}
+}
+
+// exitStatus is the status of a command stopped by sig before it completed, 128 + the signal number
+// like shells report it.
+func exitStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return int(subcommands.ExitFailure)
+}
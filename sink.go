@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/levinalex/orthanctool/ratelimit"
+)
+
+const (
+	defaultSinkMaxFiles = 5
+	defaultSinkTable    = "events"
+)
+
+// EventSink receives the events (changes, patients, ...) produced by a command.
+// Send may be called from several goroutines at once.
+type EventSink interface {
+	Send(ctx context.Context, event interface{}) error
+	Close() error
+}
+
+// stdoutSink prints every event to stdout in the format selected with -format.
+type stdoutSink struct {
+	w *eventWriter
+}
+
+func (s stdoutSink) Send(ctx context.Context, event interface{}) error {
+	return s.w.write(event)
+}
+
+func (s stdoutSink) Close() error { return nil }
+
+func (o *handlerOptions) newStdoutSink() (EventSink, error) {
+	w, err := o.newEventWriter(os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	return stdoutSink{w: w}, nil
+}
+
+// newSink returns the sink selected with -sink or -webhook, or the handler for the command given
+// after the flags. Without either, events are printed to stdout.
+func (o *handlerOptions) newSink(cmd []string) (EventSink, error) {
+	if o.sinkURL != "" && o.webhookURL != "" {
+		return nil, fmt.Errorf("-sink and -webhook cannot be combined")
+	}
+
+	var s EventSink
+	var err error
+	switch {
+	case !o.isDefault() && (len(cmd) > 0 || (o.sink() != "" && !strings.HasPrefix(o.sink(), "stdout:"))):
+		return nil, fmt.Errorf("-format, -template and -columns only apply to events printed to stdout")
+	case o.sink() != "":
+		if len(cmd) > 0 {
+			return nil, fmt.Errorf("-sink cannot be combined with a command")
+		}
+		if s, err = o.openSink(o.sink()); err != nil {
+			return nil, err
+		}
+	case len(cmd) == 0:
+		if o.mode == handlerModeStream {
+			return nil, fmt.Errorf("-handler-mode=%s needs a command", o.mode)
+		}
+		if s, err = o.newStdoutSink(); err != nil {
+			return nil, err
+		}
+	case o.mode == handlerModeExec:
+		args, err := parseHandlerArgs(cmd)
+		if err != nil {
+			return nil, err
+		}
+		s = execHandler{args: args, env: eventEnv{kind: o.eventKind, orthancURL: o.orthancURL}, timeout: o.timeout, grace: o.grace}
+	case o.mode == handlerModeStream:
+		args, err := parseHandlerArgs(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if args.hasPlaceholders() {
+			return nil, fmt.Errorf("placeholders in the command are not supported with -handler-mode=%s", o.mode)
+		}
+		env, _ := eventEnv{orthancURL: o.orthancURL}.vars(nil)
+		s = newStreamHandler(cmd, o.acks, env, o.timeout, o.grace)
+	default:
+		return nil, fmt.Errorf("invalid -handler-mode %q", o.mode)
+	}
+
+	if o.retries == 0 && o.deadLetterPath == "" {
+		return s, nil
+	}
+	r := &retryHandler{h: s, retries: o.retries, backoff: o.backoff, kind: o.eventKind}
+	if o.deadLetterPath != "" {
+		f, err := os.OpenFile(o.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		r.deadLetter = f
+	}
+	return r, nil
+}
+
+// openSink returns the sink for a -sink URL.
+func (o *handlerOptions) openSink(rawurl string) (EventSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque // relative paths like file:changes.ndjson
+	}
+	query := u.Query()
+
+	switch u.Scheme {
+	case "stdout":
+		return o.newStdoutSink()
+	case "file":
+		var maxSize float64
+		if v := query.Get("max-size"); v != "" {
+			if maxSize, err = ratelimit.ParseBytes(v); err != nil {
+				return nil, fmt.Errorf("invalid max-size in %s: %s", rawurl, err.Error())
+			}
+		}
+		maxFiles := defaultSinkMaxFiles
+		if v := query.Get("max-files"); v != "" {
+			if maxFiles, err = strconv.Atoi(v); err != nil || maxFiles < 1 {
+				return nil, fmt.Errorf("invalid max-files in %s", rawurl)
+			}
+		}
+		return openFileSink(path, int64(maxSize), maxFiles)
+	case "unix":
+		return &unixSink{path: path}, nil
+	case "http", "https":
+		headers, err := parseHeaders(o.webhookHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return newWebhookSink(rawurl, headers, []byte(o.webhookSecret), o.webhookTimeout, o.webhookBatch, o.webhookBatchWait), nil
+	case "sqlite":
+		table := defaultSinkTable
+		if v := query.Get("table"); v != "" {
+			table = v
+		}
+		return openSQLiteSink(path, table)
+	default:
+		return nil, fmt.Errorf("unsupported sink %q", rawurl)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// fileSink appends events as JSON lines to a file. With maxSize > 0, the file is rotated before it
+// would grow beyond maxSize: path becomes path.1, path.1 becomes path.2 and so on, keeping maxFiles
+// rotated files.
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	m    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openFileSink(path string, maxSize int64, maxFiles int) (*fileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink needs a path")
+	}
+	s := &fileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return s, s.open()
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f == nil {
+		// a previous rotation failed half way
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
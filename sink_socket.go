@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+const unixSinkDialTimeout = 5 * time.Second
+
+// unixSink writes events as JSON lines to a Unix domain socket. The connection is opened on the
+// first event and again after a write failed, the event that failed is reported as an error.
+type unixSink struct {
+	path string
+
+	m    sync.Mutex
+	conn net.Conn
+}
+
+func (s *unixSink) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.conn == nil {
+		d := net.Dialer{Timeout: unixSinkDialTimeout}
+		if s.conn, err = d.DialContext(ctx, "unix", s.path); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
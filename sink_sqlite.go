@@ -0,0 +1,70 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqliteSink inserts events into a table of a SQLite database, creating the table if needed.
+// Each row stores the time the event was received and the event as JSON. The driver needs cgo,
+// builds without it reject sqlite: sinks.
+type sqliteSink struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+func openSQLiteSink(path, table string) (*sqliteSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite sink needs a path")
+	}
+	if !sqliteTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time TEXT NOT NULL,
+		event TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	insert, err := db.Prepare(`INSERT INTO ` + table + ` (time, event) VALUES (?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteSink{db: db, insert: insert}, nil
+}
+
+func (s *sqliteSink) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.insert.Exec(time.Now().Format(time.RFC3339), string(b))
+	return err
+}
+
+func (s *sqliteSink) Close() error {
+	s.insert.Close()
+	return s.db.Close()
+}
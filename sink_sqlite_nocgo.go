@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import "fmt"
+
+// openSQLiteSink fails in binaries built without cgo, which the SQLite driver needs.
+func openSQLiteSink(path, table string) (EventSink, error) {
+	return nil, fmt.Errorf("sqlite sinks are not supported by this build of orthanctool, it was built without cgo")
+}
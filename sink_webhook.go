@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+const (
+	webhookSignatureHeader = "X-Orthanctool-Signature"
+	// maxWebhookErrorBody limits how much of an error response is included in the error
+	maxWebhookErrorBody = 512
+)
+
+// webhookEvent is an encoded event and the sequence number of its change, 0 for other events.
+type webhookEvent struct {
+	seq  int
+	body json.RawMessage
+}
+
+type webhookEventsBySeq []webhookEvent
+
+func (e webhookEventsBySeq) Len() int           { return len(e) }
+func (e webhookEventsBySeq) Less(i, j int) bool { return e[i].seq < e[j].seq }
+func (e webhookEventsBySeq) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// webhookBatch collects events that are posted in one request.
+type webhookBatch struct {
+	events []webhookEvent
+	done   chan struct{}
+	err    error
+}
+
+// webhookSink posts events as JSON to a URL. With batch > 1, up to batch events are posted
+// together as a JSON array. A batch is sent when it is full or wait after its first event.
+// Events of a batch are posted in the order of their sequence numbers.
+// Responses other than 2xx count as failures of all events in the request.
+type webhookSink struct {
+	url     string
+	headers http.Header
+	secret  []byte
+	client  *http.Client
+	batch   int
+	wait    time.Duration
+
+	// ctx is cancelled on Close, it aborts batches that are being posted
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m       sync.Mutex
+	pending *webhookBatch
+}
+
+func newWebhookSink(url string, headers http.Header, secret []byte, timeout time.Duration, batch int, wait time.Duration) *webhookSink {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookSink{
+		url:     url,
+		headers: headers,
+		secret:  secret,
+		client:  &http.Client{Timeout: timeout},
+		batch:   batch,
+		wait:    wait,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// eventSeq returns the sequence number of a change event.
+func eventSeq(event interface{}) int {
+	switch e := event.(type) {
+	case api.ChangeResult:
+		return e.Seq
+	case expandedChange:
+		return e.Seq
+	}
+	return 0
+}
+
+// parseHeaders parses headers given as "Name: value".
+func parseHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, v := range values {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", v)
+		}
+		headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return headers, nil
+}
+
+func (h *webhookSink) Send(ctx context.Context, event interface{}) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if h.batch <= 1 {
+		return h.post(ctx, b)
+	}
+
+	h.m.Lock()
+	batch := h.pending
+	if batch == nil {
+		batch = &webhookBatch{done: make(chan struct{})}
+		h.pending = batch
+		time.AfterFunc(h.wait, func() { h.flush(batch) })
+	}
+	batch.events = append(batch.events, webhookEvent{seq: eventSeq(event), body: b})
+	full := len(batch.events) >= h.batch
+	if full {
+		h.pending = nil
+	}
+	h.m.Unlock()
+
+	if full {
+		h.send(batch)
+	}
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends the batch if it is still waiting for more events.
+func (h *webhookSink) flush(batch *webhookBatch) {
+	h.m.Lock()
+	if h.pending != batch {
+		h.m.Unlock()
+		return
+	}
+	h.pending = nil
+	h.m.Unlock()
+	h.send(batch)
+}
+
+func (h *webhookSink) send(batch *webhookBatch) {
+	sort.Stable(webhookEventsBySeq(batch.events))
+	events := make([]json.RawMessage, len(batch.events))
+	for i, e := range batch.events {
+		events[i] = e.body
+	}
+	body, err := json.Marshal(events)
+	if err == nil {
+		err = h.post(h.ctx, body)
+	}
+	batch.err = err
+	close(batch.done)
+}
+
+func (h *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range h.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &handlerError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookErrorBody))
+		return &handlerError{Err: fmt.Errorf("%s: %s %s", h.url, resp.Status, strings.TrimSpace(string(msg)))}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Close aborts batches that are being posted and fails the batch that is still waiting for events.
+func (h *webhookSink) Close() error {
+	h.cancel()
+	h.m.Lock()
+	batch := h.pending
+	h.m.Unlock()
+	if batch != nil {
+		h.flush(batch)
+	}
+	return nil
+}
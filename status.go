@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/levinalex/orthanctool/api"
+)
+
+// minStallPolls is the number of poll intervals without a poll or change after which a change watch
+// counts as stalled, if that is longer than -health-stall-timeout.
+const minStallPolls = 3
+
+// Component states reported by the daemon command for its jobs.
+const (
+	stateRunning    = "running"
+	stateRestarting = "restarting"
+	stateFinished   = "finished"
+	stateFailed     = "failed"
+)
+
+// componentStatus is the state of a running command, or of a job of the daemon command, reported by
+// /healthz, /readyz and /status.
+type componentStatus struct {
+	name    string
+	command string
+
+	m       sync.Mutex
+	state   string
+	started time.Time
+	ready   bool
+	// poll interval of its change watch, 0 if it does not watch changes
+	pollInterval   time.Duration
+	lastActivity   time.Time // last poll or processed change
+	lastPoll       time.Time
+	pollFailures   int // polls in a row that got no response from the server
+	lastChange     *api.ChangeResult
+	lastChangeTime time.Time
+	lastError      string
+	lastErrorTime  time.Time
+	restarts       int
+	progress       func() interface{}
+}
+
+type componentKey struct{}
+
+// statusRegistry holds the components and the reachability of the servers of this process.
+type statusRegistry struct {
+	started time.Time
+
+	m          sync.Mutex
+	components []*componentStatus
+	servers    map[string]*serverStatus
+}
+
+var statuses = &statusRegistry{started: time.Now(), servers: map[string]*serverStatus{}}
+
+// register adds c, replacing an earlier component of the same name.
+func (r *statusRegistry) register(c *componentStatus) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for i, old := range r.components {
+		if old.name == c.name {
+			r.components[i] = c
+			return
+		}
+	}
+	r.components = append(r.components, c)
+}
+
+func newComponentStatus(name, command string) *componentStatus {
+	c := &componentStatus{name: name, command: command, state: stateRunning, started: time.Now()}
+	statuses.register(c)
+	return c
+}
+
+// componentFor returns the component of a job set by the daemon command in ctx, or registers a new one
+// for the command.
+func componentFor(ctx context.Context, command string) *componentStatus {
+	if c, ok := ctx.Value(componentKey{}).(*componentStatus); ok {
+		return c
+	}
+	return newComponentStatus(command, command)
+}
+
+// readyAfterListing is implemented by commands that call setReady once their initial listing is done.
+// Components of other commands are ready as soon as they run.
+type readyAfterListing interface {
+	readyAfterListing()
+}
+
+func (c *componentStatus) setReady() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.ready = true
+}
+
+// watching marks the start of a change watch polling every pollInterval.
+func (c *componentStatus) watching(pollInterval time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.pollInterval = pollInterval
+	c.lastActivity = time.Now()
+}
+
+// polled is called whenever the change watch has caught up with the server, or with the error of a
+// poll that got no response.
+func (c *componentStatus) polled(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err != nil {
+		c.pollFailures++
+		c.lastError = "polling changes: " + err.Error()
+		c.lastErrorTime = time.Now()
+		return
+	}
+	c.pollFailures = 0
+	c.lastPoll = time.Now()
+	c.lastActivity = c.lastPoll
+}
+
+func (c *componentStatus) processed(cng api.ChangeResult) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.lastChange == nil || cng.Seq > c.lastChange.Seq {
+		c.lastChange = &cng
+	}
+	c.lastChangeTime = time.Now()
+	c.lastActivity = c.lastChangeTime
+}
+
+func (c *componentStatus) setError(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastError = err.Error()
+	c.lastErrorTime = time.Now()
+}
+
+// exited records the exit status of a failed run, unless the run recorded an error of its own.
+func (c *componentStatus) exited(status int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.lastErrorTime.Before(c.started) {
+		c.lastError = fmt.Sprintf("exited with status %d", status)
+		c.lastErrorTime = time.Now()
+	}
+}
+
+func (c *componentStatus) setProgress(progress func() interface{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.progress = progress
+}
+
+func (c *componentStatus) setState(state string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if state == stateRunning && c.state == stateRestarting {
+		c.restarts++
+		c.started = time.Now()
+		c.pollFailures = 0
+	}
+	c.state = state
+}
+
+// stalled returns how long the change watch of c has neither polled nor processed a change, if that
+// is longer than the stall timeout, or 0.
+func (c *componentStatus) stalled(now time.Time, timeout time.Duration) time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.pollInterval == 0 || c.state != stateRunning {
+		return 0
+	}
+	if t := minStallPolls * c.pollInterval; t > timeout {
+		timeout = t
+	}
+	if idle := now.Sub(c.lastActivity); idle > timeout {
+		return idle
+	}
+	return 0
+}
+
+// failedPolls returns the number of polls in a row that got no response while c was running, and the
+// error of the last one.
+func (c *componentStatus) failedPolls() (int, string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.pollFailures == 0 || c.state != stateRunning {
+		return 0, ""
+	}
+	return c.pollFailures, c.lastError
+}
+
+// serverStatus counts the failed requests to a server since the last successful one. It is only reported
+// by /status: a destination that is down does not make the process unhealthy.
+type serverStatus struct {
+	failures      int
+	lastError     string
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+}
+
+// request records the outcome of a request to server. status is 0 if there was no response.
+func (r *statusRegistry) request(server string, status int) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s := r.servers[server]
+	if s == nil {
+		s = &serverStatus{}
+		r.servers[server] = s
+	}
+	switch status {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		s.failures++
+		s.lastError = "no response"
+		if status != 0 {
+			s.lastError = http.StatusText(status)
+		}
+		s.lastErrorTime = time.Now()
+	default:
+		s.failures = 0
+		s.lastSuccess = time.Now()
+	}
+}
+
+// serverNames returns the servers in order. r.m must be held.
+func (r *statusRegistry) serverNames() []string {
+	names := make([]string, 0, len(r.servers))
+	for name := range r.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// healthOptions are the limits of /healthz.
+type healthOptions struct {
+	maxFailures  int
+	stallTimeout time.Duration
+}
+
+// problems returns why the process is unhealthy.
+func (r *statusRegistry) problems(o healthOptions, now time.Time) []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	problems := []string{}
+	for _, c := range r.components {
+		if failures, lastError := c.failedPolls(); failures >= o.maxFailures {
+			problems = append(problems, fmt.Sprintf("%s: %d polls of the changes failed in a row, last error: %s", c.name, failures, lastError))
+		}
+		if idle := c.stalled(now, o.stallTimeout); idle > 0 {
+			problems = append(problems, fmt.Sprintf("%s: change watch stalled, no poll or change for %s", c.name, idle/time.Second*time.Second))
+		}
+	}
+	return problems
+}
+
+// notReady returns the components that are not ready yet.
+func (r *statusRegistry) notReady() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	names := []string{}
+	for _, c := range r.components {
+		c.m.Lock()
+		if !c.ready && c.state != stateFinished && c.state != stateFailed {
+			names = append(names, c.name)
+		}
+		c.m.Unlock()
+	}
+	if len(r.components) == 0 {
+		names = append(names, "no components started yet")
+	}
+	return names
+}
+
+type componentReport struct {
+	Name           string
+	Command        string
+	State          string
+	Started        time.Time
+	Ready          bool
+	Restarts       int               `json:",omitempty"`
+	LastPoll       *time.Time        `json:",omitempty"`
+	PollFailures   int               `json:",omitempty"`
+	LastChange     *api.ChangeResult `json:",omitempty"`
+	LastChangeTime *time.Time        `json:",omitempty"`
+	LastError      string            `json:",omitempty"`
+	LastErrorTime  *time.Time        `json:",omitempty"`
+	Progress       interface{}       `json:",omitempty"`
+}
+
+type serverReport struct {
+	Server        string
+	Failures      int
+	LastError     string     `json:",omitempty"`
+	LastErrorTime *time.Time `json:",omitempty"`
+	LastSuccess   *time.Time `json:",omitempty"`
+}
+
+type statusReport struct {
+	Started    time.Time
+	Healthy    bool
+	Ready      bool
+	Problems   []string
+	Servers    []serverReport
+	Components []componentReport
+}
+
+// optionalTime returns nil for the zero time, so it is left out of the JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (c *componentStatus) report() componentReport {
+	c.m.Lock()
+	report := componentReport{
+		Name:           c.name,
+		Command:        c.command,
+		State:          c.state,
+		Started:        c.started,
+		Ready:          c.ready,
+		Restarts:       c.restarts,
+		LastPoll:       optionalTime(c.lastPoll),
+		PollFailures:   c.pollFailures,
+		LastChange:     c.lastChange,
+		LastChangeTime: optionalTime(c.lastChangeTime),
+		LastError:      c.lastError,
+		LastErrorTime:  optionalTime(c.lastErrorTime),
+	}
+	progress := c.progress
+	c.m.Unlock()
+	if progress != nil {
+		report.Progress = progress()
+	}
+	return report
+}
+
+type componentsByName []*componentStatus
+
+func (c componentsByName) Len() int           { return len(c) }
+func (c componentsByName) Less(i, j int) bool { return c[i].name < c[j].name }
+func (c componentsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (r *statusRegistry) report(o healthOptions, now time.Time) statusReport {
+	problems := r.problems(o, now)
+	report := statusReport{
+		Started:  r.started,
+		Healthy:  len(problems) == 0,
+		Ready:    len(r.notReady()) == 0,
+		Problems: problems,
+	}
+
+	r.m.Lock()
+	components := append([]*componentStatus(nil), r.components...)
+	for _, name := range r.serverNames() {
+		s := r.servers[name]
+		report.Servers = append(report.Servers, serverReport{
+			Server:        name,
+			Failures:      s.failures,
+			LastError:     s.lastError,
+			LastErrorTime: optionalTime(s.lastErrorTime),
+			LastSuccess:   optionalTime(s.lastSuccess),
+		})
+	}
+	r.m.Unlock()
+	sort.Sort(componentsByName(components))
+	for _, c := range components {
+		report.Components = append(report.Components, c.report())
+	}
+	return report
+}
+
+// handleStatus serves /healthz, /readyz and /status.
+func (o healthOptions) handleStatus(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, statuses.problems(o, time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		notReady := statuses.notReady()
+		for i, name := range notReady {
+			notReady[i] = "not ready: " + name
+		}
+		writeCheck(w, notReady)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.MarshalIndent(statuses.report(o, time.Now()), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(b, '\n'))
+	})
+}
+
+// writeCheck answers a probe with 200 ok, or 503 and the problems one per line.
+func writeCheck(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s\n", strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
@@ -0,0 +1,235 @@
+package stringset
+
+import (
+	"bufio"
+	"container/heap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultSpillSize is the number of items a DiskStore keeps in memory before writing them to disk.
+const DefaultSpillSize = 1000000
+
+// Iterator walks over the items of a DiskStore in ascending order, in the style of bufio.Scanner.
+type Iterator interface {
+	Next() bool
+	Value() string
+	Err() error
+	Close() error
+}
+
+// DiskStore is a set of strings that can be read back in ascending order. Unlike Set it is meant
+// for computing differences between sets too large for memory. It keeps at most spillSize items in
+// memory. Whenever that many items have been added, they are sorted and written to a spill file.
+// Iterating merges all spill files, so memory use is bounded no matter how many items are stored.
+type DiskStore struct {
+	m         sync.Mutex
+	dir       string
+	spillSize int
+	buffer    []string
+	files     []string
+}
+
+// NewDiskStore creates a store that spills to a new temporary directory inside dir
+// (or the default temporary directory if dir is empty).
+func NewDiskStore(dir string, spillSize int) (*DiskStore, error) {
+	tmp, err := ioutil.TempDir(dir, "stringset-")
+	if err != nil {
+		return nil, err
+	}
+	if spillSize <= 0 {
+		spillSize = DefaultSpillSize
+	}
+	return &DiskStore{dir: tmp, spillSize: spillSize}, nil
+}
+
+func (s *DiskStore) Add(items []string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, item := range items {
+		s.buffer = append(s.buffer, item)
+		if len(s.buffer) >= s.spillSize {
+			if err := s.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spill writes the sorted buffer to a new file.
+func (s *DiskStore) spill() error {
+	if len(s.buffer) == 0 {
+		return nil
+	}
+	sort.Strings(s.buffer)
+
+	name := filepath.Join(s.dir, strconv.Itoa(len(s.files)))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for i, item := range s.buffer {
+		if i > 0 && item == s.buffer[i-1] {
+			continue
+		}
+		if _, err := w.WriteString(item + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.files = append(s.files, name)
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+// Iterator returns the distinct items in ascending order. No items may be added afterwards.
+func (s *DiskStore) Iterator() (Iterator, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.spill(); err != nil {
+		return nil, err
+	}
+
+	it := &mergeIterator{}
+	for _, name := range s.files {
+		f, err := os.Open(name)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		it.files = append(it.files, f)
+		if scanner.Scan() {
+			heap.Push(&it.heads, &spillFile{scanner: scanner, value: scanner.Text()})
+		} else if err := scanner.Err(); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// Close releases all resources held by the store.
+func (s *DiskStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.buffer = nil
+	s.files = nil
+	return os.RemoveAll(s.dir)
+}
+
+type spillFile struct {
+	scanner *bufio.Scanner
+	value   string
+}
+
+// spillHeap orders spill files by their current line.
+type spillHeap []*spillFile
+
+func (h spillHeap) Len() int            { return len(h) }
+func (h spillHeap) Less(i, j int) bool  { return h[i].value < h[j].value }
+func (h spillHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spillHeap) Push(x interface{}) { *h = append(*h, x.(*spillFile)) }
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// mergeIterator merges sorted spill files, skipping duplicates.
+type mergeIterator struct {
+	files   []*os.File
+	heads   spillHeap
+	value   string
+	started bool
+	err     error
+}
+
+func (it *mergeIterator) Next() bool {
+	for it.heads.Len() > 0 {
+		head := it.heads[0]
+		value := head.value
+		if head.scanner.Scan() {
+			head.value = head.scanner.Text()
+			heap.Fix(&it.heads, 0)
+		} else {
+			if err := head.scanner.Err(); err != nil {
+				it.err = err
+				return false
+			}
+			heap.Pop(&it.heads)
+		}
+
+		if it.started && value == it.value {
+			continue
+		}
+		it.value, it.started = value, true
+		return true
+	}
+	return false
+}
+
+func (it *mergeIterator) Value() string { return it.value }
+func (it *mergeIterator) Err() error    { return it.err }
+func (it *mergeIterator) Close() error {
+	for _, f := range it.files {
+		f.Close()
+	}
+	it.files = nil
+	return nil
+}
+
+// Difference calls f for every item of a that is missing from at least one of bs. missing holds
+// the indices of the iterators in bs that lack the item. All iterators must be sorted.
+func Difference(a Iterator, bs []Iterator, f func(item string, missing []int) error) error {
+	// advance every iterator once, exhausted ones are marked as done
+	done := make([]bool, len(bs))
+	for i, b := range bs {
+		if !b.Next() {
+			if err := b.Err(); err != nil {
+				return err
+			}
+			done[i] = true
+		}
+	}
+
+	for a.Next() {
+		item := a.Value()
+		missing := []int{}
+		for i, b := range bs {
+			for !done[i] && b.Value() < item {
+				if !b.Next() {
+					if err := b.Err(); err != nil {
+						return err
+					}
+					done[i] = true
+				}
+			}
+			if done[i] || b.Value() != item {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) > 0 {
+			if err := f(item, missing); err != nil {
+				return err
+			}
+		}
+	}
+	return a.Err()
+}
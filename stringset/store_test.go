@@ -0,0 +1,98 @@
+package stringset
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newStore returns a DiskStore holding items, spilling after every spillSize items.
+func newStore(t *testing.T, items []string, spillSize int) *DiskStore {
+	s, err := NewDiskStore("", spillSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(items); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDiskStoreIterator(t *testing.T) {
+	s := newStore(t, []string{"d", "b", "a", "d", "c", "b", "e", "a"}, 3)
+	defer s.Close()
+	it, err := s.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	got := []string{}
+	for it.Next() {
+		got = append(got, it.Value())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.files) != 3 {
+		t.Errorf("got %d spill files, expected 3", len(s.files))
+	}
+	if expected := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestDifference(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		bs      []string
+		missing string // item:indices of bs, space separated
+	}{
+		{"equal", "a b c", []string{"c b a"}, ""},
+		{"empty source", "", []string{"a b"}, ""},
+		{"empty destination", "b a", []string{""}, "a:0 b:0"},
+		{"no destinations", "a", []string{}, ""},
+		{"duplicates", "a a b b c c a", []string{"b b b"}, "a:0 c:0"},
+		{"destination ahead", "a c e", []string{"b d f"}, "a:0 c:0 e:0"},
+		{"destination behind", "x y z", []string{"a b c x"}, "y:0 z:0"},
+		{"several destinations", "a b c d e f g", []string{"a c e g", "", "g f e d c b a", "b d"}, "a:1,3 b:0,1 c:1,3 d:0,1 e:1,3 f:0,1,3 g:1,3"},
+	}
+	for _, test := range tests {
+		for _, spillSize := range []int{1, 2, 3, 100} {
+			stores := []*DiskStore{newStore(t, strings.Fields(test.a), spillSize)}
+			for _, b := range test.bs {
+				stores = append(stores, newStore(t, strings.Fields(b), spillSize))
+			}
+			iterators := []Iterator{}
+			for _, s := range stores {
+				it, err := s.Iterator()
+				if err != nil {
+					t.Fatal(err)
+				}
+				iterators = append(iterators, it)
+			}
+
+			got := []string{}
+			err := Difference(iterators[0], iterators[1:], func(item string, missing []int) error {
+				indices := []string{}
+				for _, i := range missing {
+					indices = append(indices, string('0'+rune(i)))
+				}
+				got = append(got, item+":"+strings.Join(indices, ","))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != test.missing {
+				t.Errorf("%s, spill size %d: got %q, expected %q", test.name, spillSize, strings.Join(got, " "), test.missing)
+			}
+
+			for i, s := range stores {
+				iterators[i].Close()
+				s.Close()
+			}
+		}
+	}
+}
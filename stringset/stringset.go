@@ -44,6 +44,27 @@ func (s *Set) HasKey(item string) bool {
 	return ok
 }
 
+// Count returns the number of items for which f returns true.
+func (s *Set) Count(f func(string) bool) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := 0
+	for item := range s.strings {
+		if f(item) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Set) Remove(items []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, item := range items {
+		delete(s.strings, item)
+	}
+}
+
 func (s *Set) Reset() {
 	s.m.Lock()
 	defer s.m.Unlock()